@@ -1,12 +1,19 @@
 package config
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
 	"gopkg.in/yaml.v2"
 )
@@ -14,25 +21,969 @@ import (
 type GlobalRawConfig struct {
 	ListeningPort int `yaml:"listening_port"`
 	LogLevel      int `yaml:"log_level"`
+	// TLS lists the ports that serve HTTPS instead of plain HTTP
+	TLS []TLSListenerRawConfig `yaml:"tls"`
+	// ACME obtains and renews certificates for the domains of the sites on TLS ports, disabled by default.
+	// Enabling it accepts the terms of service of the ACME server.
+	ACME *ACMERawConfig `yaml:"acme"`
+	// Admin serves the runtime controls of the sites over HTTP, disabled by default
+	Admin *AdminRawConfig `yaml:"admin"`
+}
+
+// AdminRawConfig configures the admin API. It has no authentication, so it should only listen on a loopback or private
+// address.
+type AdminRawConfig struct {
+	// Listen is the host:port address of the admin API, such as "127.0.0.1:9901". It is required.
+	Listen string `yaml:"listen"`
+}
+
+// ACMERawConfig obtains certificates with the HTTP-01 challenge, answered on the plain HTTP ports, and the
+// TLS-ALPN-01 challenge, answered on the TLS ports. HTTP-01 needs a site on port 80, and TLS-ALPN-01 a TLS port 443.
+// Only exact domains get certificates, and sites with a certificate of their own keep it.
+type ACMERawConfig struct {
+	// Email is the contact address of the ACME account, optional
+	Email string `yaml:"email"`
+	// DirectoryURL is the directory of the ACME server, Let's Encrypt by default
+	DirectoryURL string `yaml:"directory_url"`
+	// CacheDir is the directory that stores the account key and the certificates, it is required
+	CacheDir string `yaml:"cache_dir"`
+	// CACert is a PEM file of the root certificates that the ACME server is trusted with, on top of the system ones.
+	// Test servers such as Pebble need it.
+	CACert string `yaml:"ca_cert"`
+	// RenewBefore is how long before they expire certificates are renewed, 30 days by default
+	RenewBefore time.Duration `yaml:"renew_before"`
+}
+
+// TLSListenerRawConfig turns on TLS for the sites of a port. The certificate is chosen by SNI among the certificates of
+// the sites of the port, and the certificate of the listener is used when none of them matches.
+type TLSListenerRawConfig struct {
+	Port int `yaml:"port"`
+	// Cert and Key are the PEM files of the default certificate, they are required unless ACME is enabled
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// MinVersion is "1.0", "1.1", "1.2" or "1.3", "1.2" by default
+	MinVersion string `yaml:"min_version"`
+	// CipherSuites lists the cipher suites allowed up to TLS 1.2 by name, such as
+	// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. The Go defaults are used when it is empty. TLS 1.3 suites can't be
+	// configured.
+	CipherSuites []string `yaml:"cipher_suites"`
+}
+
+// SiteTLSRawConfig is the certificate that a site serves on a TLS port, for its domain
+type SiteTLSRawConfig struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+}
+
+// EndpointRawConfig is an entry of the endpoint list of a site. It can be written as a plain URL string, or as a map
+// with the URL and its weight.
+type EndpointRawConfig struct {
+	URL string `yaml:"url"`
+	// Weight is the share of traffic the endpoint gets relative to the other endpoints of the site, 1 by default. A
+	// weight of 0 parks the endpoint: it keeps being health checked, but gets no traffic.
+	Weight *int `yaml:"weight"`
+}
+
+func (e *EndpointRawConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var plainURL string
+	if err := unmarshal(&plainURL); err == nil {
+		e.URL = plainURL
+		return nil
+	}
+	type endpointMap EndpointRawConfig
+	return unmarshal((*endpointMap)(e))
 }
 
 type SiteRawConfig struct {
-	Endpoints   []string      `yaml:"endpoints"`
-	CheckPeriod time.Duration `yaml:"check_period"`
+	// Type is "proxy" by default, which forwards requests to the endpoints. "static" and "redirect" sites answer by
+	// themselves and have no endpoints.
+	Type        string              `yaml:"type"`
+	Endpoints   []EndpointRawConfig `yaml:"endpoints"`
+	CheckPeriod time.Duration       `yaml:"check_period"`
 	// Domain is the FQDN. disabled by default
+	// A domain starting with "*." matches any host under it, and a domain starting with "~" is a regular expression
+	// that has to match the whole host. Exact domains win over wildcards, longer wildcards win over shorter ones, and
+	// regular expressions are tried last, in the order of the configuration file.
 	Domain string `yaml:"domain"`
 	// Path is what comes after the FQDN, "/" by default
 	Path string `yaml:"path"`
 	// Port is the same as the global listening port by default
 	Port int `yaml:"port"`
+	// Fallback makes the site serve the requests for unknown hosts on its port, only one site per port can be the
+	// fallback. The default site can't be one, as it serves every host of the global port already.
+	Fallback bool `yaml:"fallback"`
+	// Algorithm is the load balancing algorithm used to choose an endpoint, "random" by default
+	Algorithm string `yaml:"algorithm"`
+	// HashKey is what the ring_hash algorithm hashes to choose an endpoint: "client_ip" (the default), "path",
+	// "header:<name>" or "cookie:<name>". It is an error with the other algorithms.
+	HashKey string `yaml:"hash_key"`
+	// StickySession pins clients to an endpoint with a cookie, disabled by default
+	StickySession *StickySessionRawConfig `yaml:"sticky_session"`
+	// HealthCheck defines the request that checks whether an endpoint is healthy
+	HealthCheck HealthCheckRawConfig `yaml:"health_check"`
+	// OutlierDetection ejects endpoints that fail live requests, disabled by default
+	OutlierDetection *OutlierDetectionRawConfig `yaml:"outlier_detection"`
+	// ResponseTimeout is how long an endpoint can take to send the headers of its response, disabled by default so
+	// that long polling endpoints can take their time. A request that times out gets a 504, and counts as a failure
+	// of the endpoint.
+	ResponseTimeout time.Duration `yaml:"response_timeout"`
+	// AgentCheck polls an agent next to each endpoint that reports its state or weight, disabled by default
+	AgentCheck *AgentCheckRawConfig `yaml:"agent_check"`
+	// Match restricts the site to the requests that meet all of its rules. Several sites can share a path when they
+	// have match rules: they are tried in the order of the configuration file, before the site of the path without
+	// match rules.
+	Match *MatchRawConfig `yaml:"match"`
+	// Groups split the traffic of the site between named sets of endpoints, such as stable and canary releases. A site
+	// has either endpoints or groups.
+	Groups []EndpointGroupRawConfig `yaml:"groups"`
+	// GroupSticky keeps clients in the group they were first sent to with a cookie, disabled by default
+	GroupSticky *GroupStickyRawConfig `yaml:"group_sticky"`
+	// Mirror copies a share of the requests to a shadow endpoint group, disabled by default
+	Mirror *MirrorRawConfig `yaml:"mirror"`
+	// Static is the response of static sites
+	Static *StaticRawConfig `yaml:"static"`
+	// Redirect is the response of redirect sites
+	Redirect *RedirectRawConfig `yaml:"redirect"`
+	// TLS is the certificate of the domain of the site, its port needs to be a TLS port. The default certificate of
+	// the port is used by default.
+	TLS *SiteTLSRawConfig `yaml:"tls"`
+	// Maintenance is the page that the site serves instead of its usual response while it is in maintenance mode.
+	// Maintenance mode can be toggled at runtime for any site, from the admin API.
+	Maintenance *MaintenanceRawConfig `yaml:"maintenance"`
+	// StripPrefix is removed from the start of the request path before it is sent to the endpoints, so that a site at
+	// /api/* can forward /api/users as /users
+	StripPrefix string `yaml:"strip_prefix"`
+	// Rewrite rules are applied in order after StripPrefix
+	Rewrite []RewriteRawConfig `yaml:"rewrite"`
+	// AddPrefix is added to the start of the path after StripPrefix and Rewrite. The path of the endpoint URL always
+	// comes first.
+	AddPrefix string `yaml:"add_prefix"`
+}
+
+type EndpointGroupRawConfig struct {
+	Name string `yaml:"name"`
+	// Weight is the share of requests the group gets relative to the other groups, 1 by default. With weights that add
+	// up to 100, they are percentages. A group with a weight of 0 gets no requests.
+	Weight    *int                `yaml:"weight"`
+	Endpoints []EndpointRawConfig `yaml:"endpoints"`
+}
+
+type GroupStickyRawConfig struct {
+	// Cookie is the name of the cookie that names the group, "lbx_group" by default
+	Cookie string `yaml:"cookie"`
+	// MaxAge is the lifetime of the cookie, which lasts for the browser session by default
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+// MirrorRawConfig sends copies of live requests to an endpoint group of the site. Clients only ever get the response
+// of the primary endpoint, the shadow responses are thrown away.
+type MirrorRawConfig struct {
+	// Group is the endpoint group that gets the copies, it is required. A group with a weight of 0 gets no primary
+	// traffic.
+	Group string `yaml:"group"`
+	// Percent is the share of requests that is copied, 100 by default
+	Percent *float64 `yaml:"percent"`
+	// Compare logs and counts the differences in status, headers and body hash between the primary and shadow
+	// responses, disabled by default
+	Compare bool `yaml:"compare"`
+	// CompareHeaders lists the headers that are compared, only Content-Type by default
+	CompareHeaders []string `yaml:"compare_headers"`
+	// MaxBodySize is the largest request body in bytes that is mirrored, 1 MiB by default. Requests with larger
+	// bodies are not copied.
+	MaxBodySize int64 `yaml:"max_body_size"`
+	// Timeout is how long a shadow request can take, 10 seconds by default
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+type StaticRawConfig struct {
+	// Status is 200 by default
+	Status int    `yaml:"status"`
+	Body   string `yaml:"body"`
+	// ContentType is "text/plain; charset=utf-8" by default
+	ContentType string            `yaml:"content_type"`
+	Headers     map[string]string `yaml:"headers"`
+}
+
+type RedirectRawConfig struct {
+	// Status is 301, 302, 307 or 308, 302 by default
+	Status int `yaml:"status"`
+	// Target is the URL that clients are sent to. It can use the {scheme}, {host}, {path} and {query} placeholders
+	// of the request, and {uri}, which is the path followed by the query if there is one.
+	Target string `yaml:"target"`
+}
+
+type MaintenanceRawConfig struct {
+	// Enabled starts the site in maintenance mode
+	Enabled bool `yaml:"enabled"`
+	// Body is the page served with a 503 status, a short notice by default
+	Body string `yaml:"body"`
+	// ContentType is "text/html; charset=utf-8" by default
+	ContentType string `yaml:"content_type"`
+	// RetryAfter is sent as the Retry-After header in seconds, no header is sent by default
+	RetryAfter time.Duration `yaml:"retry_after"`
+}
+
+// RewriteRawConfig replaces the matches of a regular expression in the request path. The replacement can refer to the
+// groups of the expression as $1 or ${name}.
+type RewriteRawConfig struct {
+	Regex       string `yaml:"regex"`
+	Replacement string `yaml:"replacement"`
+}
+
+type MatchRawConfig struct {
+	// Methods lists the accepted HTTP methods, any method is accepted by default
+	Methods []string `yaml:"methods"`
+	// Headers, Query and Cookies list the request headers, query parameters and cookies that have to match
+	Headers []ValueMatchRawConfig `yaml:"headers"`
+	Query   []ValueMatchRawConfig `yaml:"query"`
+	Cookies []ValueMatchRawConfig `yaml:"cookies"`
+}
+
+// ValueMatchRawConfig matches a named request value. Only one of Exact, Prefix and Regex can be set, and when none of
+// them is, the value only has to be present.
+type ValueMatchRawConfig struct {
+	Name   string `yaml:"name"`
+	Exact  string `yaml:"exact"`
+	Prefix string `yaml:"prefix"`
+	Regex  string `yaml:"regex"`
+}
+
+// AgentCheckRawConfig follows the agent-check protocol of HAProxy. lbx connects to the agent port of the endpoint,
+// optionally sends a string, and reads one line such as "up", "drain", "down", "maint", "ready" or "50%". A drained
+// endpoint only keeps the clients pinned to it by sticky_session, and the words that lbx doesn't know are skipped.
+type AgentCheckRawConfig struct {
+	// Port is the agent port on the endpoint host, it is required
+	Port int `yaml:"port"`
+	// Send is written to the agent after connecting, nothing is sent by default
+	Send string `yaml:"send"`
+	// Timeout is 2 seconds by default
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+type OutlierDetectionRawConfig struct {
+	// ConsecutiveFailures is the number of connection errors, timeouts and 5xx responses in a row that eject an
+	// endpoint, 5 by default
+	ConsecutiveFailures int `yaml:"consecutive_failures"`
+	// EjectionTime is how long an endpoint is ejected the first time, 30 seconds by default. It doubles every time the
+	// endpoint is ejected again.
+	EjectionTime time.Duration `yaml:"ejection_time"`
+	// MaxEjectionTime caps the ejection time, 5 minutes by default
+	MaxEjectionTime time.Duration `yaml:"max_ejection_time"`
+	// MaxEjectionPercent is the share of the endpoints of the site that can be ejected at once, 50 by default. Any
+	// value above 0 allows at least one endpoint to be ejected.
+	MaxEjectionPercent *int `yaml:"max_ejection_percent"`
+}
+
+type HealthCheckRawConfig struct {
+	// Type is "http" by default, "tcp" to only check that a connection to the endpoint can be opened, or "grpc" to
+	// call the gRPC health checking protocol. TCP and gRPC checks use TLS when the endpoint scheme is https.
+	Type string `yaml:"type"`
+	// Service is the service name sent by gRPC checks, the empty name asks for the health of the whole server
+	Service string `yaml:"service"`
+	// Path is appended to the endpoint URL, the bare endpoint URL is checked by default
+	Path string `yaml:"path"`
+	// Method is HEAD by default, or GET when the body is checked
+	Method string `yaml:"method"`
+	// ExpectedStatuses lists status codes such as "200", or ranges such as "200-399". Any status below 500 is
+	// expected by default.
+	ExpectedStatuses []string `yaml:"expected_statuses"`
+	// Body is a substring that the response body must contain
+	Body string `yaml:"body"`
+	// BodyRegex is a regular expression that the response body must match
+	BodyRegex string `yaml:"body_regex"`
+	// Headers are added to the check request. A "Host" header replaces the host of the endpoint URL.
+	Headers map[string]string `yaml:"headers"`
+	// Timeout is 5 seconds by default
+	Timeout time.Duration `yaml:"timeout"`
+	// Port is the endpoint port by default
+	Port int `yaml:"port"`
+	// HealthyThreshold is the number of consecutive successful checks that bring an unhealthy endpoint back, 2 by default
+	HealthyThreshold int `yaml:"healthy_threshold"`
+	// UnhealthyThreshold is the number of consecutive failed checks that evict a healthy endpoint, 3 by default
+	UnhealthyThreshold int `yaml:"unhealthy_threshold"`
+	// Concurrency is the number of endpoints of the site that are checked at the same time, 8 by default
+	Concurrency int `yaml:"concurrency"`
+	// Jitter is the longest random delay added to each check period, a tenth of the check period by default
+	Jitter *time.Duration `yaml:"jitter"`
+	// MaxInterval is the longest time between two checks of an unhealthy endpoint that keeps failing, eight times the
+	// check period by default. The interval doubles with every failed check until it reaches MaxInterval.
+	MaxInterval time.Duration `yaml:"max_interval"`
+}
+
+type StickySessionRawConfig struct {
+	// Cookie is the name of the cookie that names the endpoint, "lbx_sticky_" followed by the site name by default, so
+	// that the sticky sites of a host don't overwrite each other's cookie
+	Cookie string `yaml:"cookie"`
+	// Secret signs the cookie. When it is empty, a random secret is generated on every start, so clients are
+	// re-pinned after a restart.
+	Secret string `yaml:"secret"`
+	// MaxAge is the lifetime of the cookie, which lasts for the browser session by default
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+type EndpointParsedConfig struct {
+	URL    url.URL
+	Weight uint
 }
 
 type SiteParsedConfig struct {
-	Endpoints     []url.URL
-	RefreshPeriod time.Duration
-	Domain        string
-	Path          string
-	Port          uint16
+	Endpoints        []EndpointParsedConfig
+	RefreshPeriod    time.Duration
+	Domain           string
+	Path             string
+	Port             uint16
+	Fallback         bool
+	Algorithm        string
+	HashKey          HashKeyParsedConfig
+	StickySession    *StickySessionParsedConfig
+	HealthCheck      HealthCheckParsedConfig
+	OutlierDetection *OutlierDetectionParsedConfig
+	ResponseTimeout  time.Duration
+	AgentCheck       *AgentCheckParsedConfig
+	Match            *MatchParsedConfig
+	StripPrefix      string
+	Rewrite          []RewriteParsedConfig
+	AddPrefix        string
+	Groups           []EndpointGroupParsedConfig
+	GroupSticky      *GroupStickyParsedConfig
+	Mirror           *MirrorParsedConfig
+	Type             string
+	Static           *StaticParsedConfig
+	Redirect         *RedirectParsedConfig
+	Maintenance      *MaintenanceParsedConfig
+	TLS              *SiteTLSParsedConfig
+}
+
+type SiteTLSParsedConfig struct {
+	Cert string
+	Key  string
+}
+
+type ACMEParsedConfig struct {
+	Email        string
+	DirectoryURL string
+	CacheDir     string
+	CACert       string
+	RenewBefore  time.Duration
+}
+
+type AdminParsedConfig struct {
+	Listen string
+	Port   uint16
+}
+
+type TLSListenerParsedConfig struct {
+	Cert         string
+	Key          string
+	MinVersion   uint16
+	CipherSuites []uint16
+}
+
+type StaticParsedConfig struct {
+	Status  int
+	Body    string
+	Headers map[string]string
+}
+
+type RedirectParsedConfig struct {
+	Status int
+	Target string
+}
+
+type MaintenanceParsedConfig struct {
+	Enabled     bool
+	Body        string
+	ContentType string
+	RetryAfter  time.Duration
+}
+
+type MirrorParsedConfig struct {
+	Group          string
+	Percent        float64
+	Compare        bool
+	CompareHeaders []string
+	MaxBodySize    int64
+	Timeout        time.Duration
+}
+
+type EndpointGroupParsedConfig struct {
+	Name      string
+	Weight    uint
+	Endpoints []EndpointParsedConfig
+}
+
+type GroupStickyParsedConfig struct {
+	Cookie string
+	MaxAge time.Duration
+}
+
+type RewriteParsedConfig struct {
+	Regex       *regexp.Regexp
+	Replacement string
+}
+
+type MatchParsedConfig struct {
+	Methods []string
+	Headers []ValueMatchParsedConfig
+	Query   []ValueMatchParsedConfig
+	Cookies []ValueMatchParsedConfig
+}
+
+type ValueMatchParsedConfig struct {
+	Name   string
+	Exact  string
+	Prefix string
+	Regex  *regexp.Regexp
+}
+
+type AgentCheckParsedConfig struct {
+	Port    uint16
+	Send    string
+	Timeout time.Duration
+}
+
+type OutlierDetectionParsedConfig struct {
+	ConsecutiveFailures uint
+	EjectionTime        time.Duration
+	MaxEjectionTime     time.Duration
+	MaxEjectionPercent  uint
+}
+
+// parseValueMatches validates the rules of a match block for one kind of request value
+func parseValueMatches(kind string, raw []ValueMatchRawConfig) ([]ValueMatchParsedConfig, error) {
+	var parsed []ValueMatchParsedConfig
+	for _, rule := range raw {
+		if rule.Name == "" {
+			return nil, errors.New(fmt.Sprintf("%s rule without a name", kind))
+		}
+		set := 0
+		for _, v := range []string{rule.Exact, rule.Prefix, rule.Regex} {
+			if v != "" {
+				set++
+			}
+		}
+		if set > 1 {
+			return nil, errors.New(fmt.Sprintf("%s rule %s can only have one of exact, prefix and regex", kind, rule.Name))
+		}
+		vm := ValueMatchParsedConfig{Name: rule.Name, Exact: rule.Exact, Prefix: rule.Prefix}
+		if kind == "header" {
+			vm.Name = http.CanonicalHeaderKey(rule.Name)
+		}
+		if rule.Regex != "" {
+			re, err := regexp.Compile(rule.Regex)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("invalid regex for %s rule %s: %s", kind, rule.Name, err.Error()))
+			}
+			vm.Regex = re
+		}
+		parsed = append(parsed, vm)
+	}
+	return parsed, nil
+}
+
+// parseMatch validates a match block
+func parseMatch(raw MatchRawConfig) (*MatchParsedConfig, error) {
+	var m MatchParsedConfig
+	for _, method := range raw.Methods {
+		if method == "" || strings.ContainsAny(method, " \t/") {
+			return nil, errors.New(fmt.Sprintf("invalid method %q", method))
+		}
+		m.Methods = append(m.Methods, strings.ToUpper(method))
+	}
+	var err error
+	if m.Headers, err = parseValueMatches("header", raw.Headers); err != nil {
+		return nil, err
+	}
+	if m.Query, err = parseValueMatches("query", raw.Query); err != nil {
+		return nil, err
+	}
+	if m.Cookies, err = parseValueMatches("cookie", raw.Cookies); err != nil {
+		return nil, err
+	}
+	if len(m.Methods) == 0 && len(m.Headers) == 0 && len(m.Query) == 0 && len(m.Cookies) == 0 {
+		return nil, errors.New("match block without rules")
+	}
+	return &m, nil
+}
+
+// parseEndpoints checks that the endpoints are HTTP or HTTPS URLs with a host, and that their weights aren't negative
+func parseEndpoints(siteName string, raw []EndpointRawConfig) ([]EndpointParsedConfig, error) {
+	var parsed []EndpointParsedConfig
+	for _, endpoint := range raw {
+		u, err := url.Parse(endpoint.URL)
+		if err != nil {
+			// TODO test this
+			return nil, errors.New(fmt.Sprintf("%s is not a valid endpoint: %s", endpoint.URL, err.Error()))
+		} else if err == nil && u.Scheme == "" && u.Host == "" {
+			return nil, errors.New(fmt.Sprintf("%s is not a valid endpoint: endpoints must have a scheme and a host", u))
+		} else if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, errors.New(fmt.Sprintf("%s is not a valid endpoint: lbx only supports HTTP and HTTPS endpoints", u))
+		}
+		weight := 1
+		if endpoint.Weight != nil {
+			weight = *endpoint.Weight
+		}
+		if weight < 0 {
+			return nil, errors.New(fmt.Sprintf("weight %d of endpoint %s for site %s cannot be negative", weight, u, siteName))
+		}
+		parsed = append(parsed, EndpointParsedConfig{URL: *u, Weight: uint(weight)})
+	}
+	return parsed, nil
+}
+
+// parseGroups validates the endpoint groups of a site. A weight of 0 takes the group out of rotation, but at least
+// one group needs some traffic.
+func parseGroups(siteName string, raw []EndpointGroupRawConfig) ([]EndpointGroupParsedConfig, error) {
+	var parsed []EndpointGroupParsedConfig
+	var total int
+	for _, group := range raw {
+		if group.Name == "" {
+			return nil, errors.New(fmt.Sprintf("endpoint group without a name for site %s", siteName))
+		}
+		if slices.ContainsFunc(parsed, func(g EndpointGroupParsedConfig) bool { return g.Name == group.Name }) {
+			return nil, errors.New(fmt.Sprintf("endpoint group %s defined more than once for site %s", group.Name, siteName))
+		}
+		if len(group.Endpoints) == 0 {
+			return nil, errors.New(fmt.Sprintf("endpoint group %s of site %s has no endpoints", group.Name, siteName))
+		}
+		weight := 1
+		if group.Weight != nil {
+			weight = *group.Weight
+		}
+		if weight < 0 {
+			return nil, errors.New(fmt.Sprintf("weight %d of endpoint group %s for site %s cannot be negative", weight, group.Name, siteName))
+		}
+		total += weight
+		endpoints, err := parseEndpoints(siteName, group.Endpoints)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, EndpointGroupParsedConfig{Name: group.Name, Weight: uint(weight), Endpoints: endpoints})
+	}
+	if total == 0 {
+		return nil, errors.New(fmt.Sprintf("all the endpoint groups of site %s have a weight of 0", siteName))
+	}
+	return parsed, nil
+}
+
+// parseMirror checks that the mirror copies requests to an endpoint group of the site, all of them by default. The
+// responses are compared on their Content-Type header only, unless compare_headers names others, which takes compare.
+func parseMirror(raw MirrorRawConfig, groups []EndpointGroupParsedConfig) (*MirrorParsedConfig, error) {
+	m := MirrorParsedConfig{Group: raw.Group, Percent: 100, Compare: raw.Compare, MaxBodySize: 1 << 20, Timeout: 10 * time.Second}
+	if !slices.ContainsFunc(groups, func(g EndpointGroupParsedConfig) bool { return g.Name == raw.Group }) {
+		return nil, errors.New(fmt.Sprintf("the site has no endpoint group %q to mirror requests to", raw.Group))
+	}
+	if raw.Percent != nil {
+		if *raw.Percent < 0 || *raw.Percent > 100 {
+			return nil, errors.New(fmt.Sprintf("percent %v is not between 0 and 100", *raw.Percent))
+		}
+		m.Percent = *raw.Percent
+	}
+	if len(raw.CompareHeaders) > 0 && !raw.Compare {
+		return nil, errors.New("compare_headers is set but compare is disabled")
+	}
+	m.CompareHeaders = []string{"Content-Type"}
+	if len(raw.CompareHeaders) > 0 {
+		m.CompareHeaders = nil
+		for _, h := range raw.CompareHeaders {
+			m.CompareHeaders = append(m.CompareHeaders, http.CanonicalHeaderKey(h))
+		}
+	}
+	if raw.MaxBodySize < 0 {
+		return nil, errors.New(fmt.Sprintf("max_body_size %d cannot be negative", raw.MaxBodySize))
+	}
+	if raw.MaxBodySize > 0 {
+		m.MaxBodySize = raw.MaxBodySize
+	}
+	if raw.Timeout < 0 {
+		return nil, errors.New(fmt.Sprintf("timeout %v cannot be negative", raw.Timeout))
+	}
+	if raw.Timeout > 0 {
+		m.Timeout = raw.Timeout
+	}
+	return &m, nil
+}
+
+// parsePathPrefix makes a strip_prefix or add_prefix setting start with a slash and end without one
+func parsePathPrefix(prefix string) string {
+	if prefix == "" {
+		return ""
+	}
+	if !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
+	}
+	return strings.TrimRight(prefix, "/")
+}
+
+// DomainRegexp compiles a "~" regex domain. Host names are case insensitive, and the expression has to match the
+// whole host.
+func DomainRegexp(domain string) (*regexp.Regexp, error) {
+	return regexp.Compile("(?i)^(?:" + strings.TrimPrefix(domain, "~") + ")$")
+}
+
+// parseDomain validates a domain and lowers the case of exact and wildcard domains
+func parseDomain(domain string) (string, error) {
+	if strings.HasPrefix(domain, "~") {
+		if domain == "~" {
+			return "", errors.New("regex domain cannot be empty")
+		}
+		if _, err := DomainRegexp(domain); err != nil {
+			return "", err
+		}
+		return domain, nil
+	}
+	domain = strings.ToLower(domain)
+	suffix := strings.TrimPrefix(domain, "*.")
+	if strings.Contains(suffix, "*") {
+		return "", errors.New(fmt.Sprintf("wildcard domain %s can only have a \"*.\" prefix", domain))
+	}
+	if strings.HasPrefix(domain, "*.") && (suffix == "" || strings.HasPrefix(suffix, ".")) {
+		return "", errors.New(fmt.Sprintf("wildcard domain %s needs a domain after \"*.\"", domain))
+	}
+	if strings.ContainsAny(domain, ":/ ") {
+		return "", errors.New(fmt.Sprintf("domain %s can only be a host name", domain))
+	}
+	return domain, nil
+}
+
+// parseOutlierDetection ejects an endpoint after 5 failures in a row, for 30 seconds at first and 5 minutes at most,
+// and never more than half of the endpoints at once, unless the settings say otherwise. The longest ejection can't be
+// shorter than the first one.
+func parseOutlierDetection(raw OutlierDetectionRawConfig) (*OutlierDetectionParsedConfig, error) {
+	od := OutlierDetectionParsedConfig{
+		ConsecutiveFailures: 5,
+		EjectionTime:        30 * time.Second,
+		MaxEjectionTime:     5 * time.Minute,
+		MaxEjectionPercent:  50,
+	}
+	if raw.ConsecutiveFailures < 0 {
+		return nil, errors.New(fmt.Sprintf("consecutive_failures %d cannot be negative", raw.ConsecutiveFailures))
+	}
+	if raw.ConsecutiveFailures > 0 {
+		od.ConsecutiveFailures = uint(raw.ConsecutiveFailures)
+	}
+	if raw.EjectionTime < 0 || raw.MaxEjectionTime < 0 {
+		return nil, errors.New("ejection times cannot be negative")
+	}
+	if raw.EjectionTime > 0 {
+		od.EjectionTime = raw.EjectionTime
+	}
+	if raw.MaxEjectionTime > 0 {
+		od.MaxEjectionTime = raw.MaxEjectionTime
+	}
+	if od.MaxEjectionTime < od.EjectionTime {
+		return nil, errors.New(fmt.Sprintf("max_ejection_time %v cannot be less than ejection_time %v", od.MaxEjectionTime, od.EjectionTime))
+	}
+	if raw.MaxEjectionPercent != nil {
+		if *raw.MaxEjectionPercent < 0 || *raw.MaxEjectionPercent > 100 {
+			return nil, errors.New(fmt.Sprintf("max_ejection_percent %d must be between 0 and 100", *raw.MaxEjectionPercent))
+		}
+		od.MaxEjectionPercent = uint(*raw.MaxEjectionPercent)
+	}
+	return &od, nil
+}
+
+type StatusRange struct {
+	Min int
+	Max int
+}
+
+type HealthCheckParsedConfig struct {
+	Type               string
+	Service            string
+	Path               string
+	Method             string
+	ExpectedStatuses   []StatusRange
+	Body               string
+	BodyRegex          *regexp.Regexp
+	Headers            map[string]string
+	Timeout            time.Duration
+	Port               uint16
+	HealthyThreshold   uint
+	UnhealthyThreshold uint
+	Concurrency        uint
+	Jitter             time.Duration
+	MaxInterval        time.Duration
+}
+
+// HealthCheckTypes lists the kinds of health checks that a site can use
+var HealthCheckTypes = []string{"http", "tcp", "grpc"}
+
+// DefaultHealthCheck sends HEAD to the endpoint URL and expects any status below 500 within 5 seconds. Endpoints need
+// 2 successful checks in a row to become healthy, and 3 failed checks in a row to become unhealthy. Jitter and
+// MaxInterval depend on the check period, so they are left for the caller to set.
+func DefaultHealthCheck() HealthCheckParsedConfig {
+	return HealthCheckParsedConfig{
+		Type:               "http",
+		Method:             http.MethodHead,
+		ExpectedStatuses:   []StatusRange{{Min: 100, Max: 499}},
+		Timeout:            5 * time.Second,
+		HealthyThreshold:   2,
+		UnhealthyThreshold: 3,
+		Concurrency:        8,
+	}
+}
+
+// parseHealthCheck applies the defaults of DefaultHealthCheck to the settings that are not set, and validates the rest
+func parseHealthCheck(raw HealthCheckRawConfig) (HealthCheckParsedConfig, error) {
+	hc := DefaultHealthCheck()
+	if raw.Type != "" {
+		hc.Type = raw.Type
+	}
+	switch hc.Type {
+	case "http", "tcp":
+	case "grpc":
+		hc.Service = raw.Service
+	default:
+		return hc, errors.New(fmt.Sprintf("unknown health check type %s, valid types are: %s", raw.Type, strings.Join(HealthCheckTypes, ", ")))
+	}
+	if hc.Type != "http" && (raw.Path != "" || raw.Method != "" || len(raw.ExpectedStatuses) > 0 || raw.Body != "" || raw.BodyRegex != "" || len(raw.Headers) > 0) {
+		return hc, errors.New("path, method, expected_statuses, body, body_regex and headers are only used by http health checks")
+	}
+	if hc.Type != "grpc" && raw.Service != "" {
+		return hc, errors.New("service is only used by grpc health checks")
+	}
+	if raw.Path != "" && !strings.HasPrefix(raw.Path, "/") {
+		raw.Path = "/" + raw.Path
+	}
+	hc.Path = raw.Path
+	if raw.Body != "" || raw.BodyRegex != "" {
+		// There is no body to check in a response to HEAD
+		hc.Method = http.MethodGet
+	}
+	if raw.Method != "" {
+		hc.Method = strings.ToUpper(raw.Method)
+	}
+	if strings.ContainsAny(hc.Method, " \t/()<>@,;:\\\"[]?={}") {
+		return hc, errors.New(fmt.Sprintf("%s is not a valid HTTP method", raw.Method))
+	}
+	if len(raw.ExpectedStatuses) > 0 {
+		hc.ExpectedStatuses = nil
+	}
+	for _, status := range raw.ExpectedStatuses {
+		minStr, maxStr, isRange := strings.Cut(status, "-")
+		if !isRange {
+			maxStr = minStr
+		}
+		statusMin, minErr := strconv.Atoi(strings.TrimSpace(minStr))
+		statusMax, maxErr := strconv.Atoi(strings.TrimSpace(maxStr))
+		if minErr != nil || maxErr != nil || statusMin < 100 || statusMax > 599 || statusMin > statusMax {
+			return hc, errors.New(fmt.Sprintf("%s is not a valid status code or range of status codes", status))
+		}
+		hc.ExpectedStatuses = append(hc.ExpectedStatuses, StatusRange{Min: statusMin, Max: statusMax})
+	}
+	hc.Body = raw.Body
+	if raw.BodyRegex != "" {
+		re, err := regexp.Compile(raw.BodyRegex)
+		if err != nil {
+			return hc, errors.New(fmt.Sprintf("invalid body_regex: %s", err.Error()))
+		}
+		hc.BodyRegex = re
+	}
+	hc.Headers = raw.Headers
+	if raw.Timeout < 0 {
+		return hc, errors.New(fmt.Sprintf("timeout %v cannot be negative", raw.Timeout))
+	}
+	if raw.Timeout > 0 {
+		hc.Timeout = raw.Timeout
+	}
+	if raw.Port < 0 || raw.Port > 65535 {
+		return hc, errors.New(fmt.Sprintf("port number %d is out of range", raw.Port))
+	}
+	hc.Port = uint16(raw.Port)
+	if raw.HealthyThreshold < 0 || raw.UnhealthyThreshold < 0 {
+		return hc, errors.New("thresholds cannot be negative")
+	}
+	if raw.HealthyThreshold > 0 {
+		hc.HealthyThreshold = uint(raw.HealthyThreshold)
+	}
+	if raw.UnhealthyThreshold > 0 {
+		hc.UnhealthyThreshold = uint(raw.UnhealthyThreshold)
+	}
+	if raw.Concurrency < 0 {
+		return hc, errors.New(fmt.Sprintf("concurrency %d cannot be negative", raw.Concurrency))
+	}
+	if raw.Concurrency > 0 {
+		hc.Concurrency = uint(raw.Concurrency)
+	}
+	if raw.Jitter != nil {
+		if *raw.Jitter < 0 {
+			return hc, errors.New(fmt.Sprintf("jitter %v cannot be negative", *raw.Jitter))
+		}
+		hc.Jitter = *raw.Jitter
+	}
+	if raw.MaxInterval < 0 {
+		return hc, errors.New(fmt.Sprintf("max_interval %v cannot be negative", raw.MaxInterval))
+	}
+	hc.MaxInterval = raw.MaxInterval
+	return hc, nil
+}
+
+// stickyCookieName is the default sticky cookie of a site. The characters of the site name that can't be in a cookie
+// name are replaced with underscores.
+func stickyCookieName(siteName string) string {
+	return "lbx_sticky_" + strings.Map(func(r rune) rune {
+		if r < 0x80 && (unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("-_.", r)) {
+			return r
+		}
+		return '_'
+	}, siteName)
+}
+
+type StickySessionParsedConfig struct {
+	Cookie string
+	Secret string
+	MaxAge time.Duration
+}
+
+// HashKeyParsedConfig is the part of a request that the ring_hash algorithm hashes. Name is only set for the header
+// and cookie sources.
+type HashKeyParsedConfig struct {
+	Source string
+	Name   string
+}
+
+// TLSVersions maps the min_version settings to their TLS versions
+var TLSVersions = map[string]uint16{"1.0": tls.VersionTLS10, "1.1": tls.VersionTLS11, "1.2": tls.VersionTLS12, "1.3": tls.VersionTLS13}
+
+// DefaultACMEDirectory is the production directory of Let's Encrypt
+const DefaultACMEDirectory = "https://acme-v02.api.letsencrypt.org/directory"
+
+// parseACME requires a cache directory, and uses the production directory of Let's Encrypt and a renewal 30 days before
+// the certificates expire by default. The directory has to be an https URL.
+func parseACME(raw ACMERawConfig) (*ACMEParsedConfig, error) {
+	a := ACMEParsedConfig{Email: raw.Email, DirectoryURL: raw.DirectoryURL, CacheDir: raw.CacheDir, CACert: raw.CACert, RenewBefore: raw.RenewBefore}
+	if a.CacheDir == "" {
+		return nil, errors.New("cache_dir is required")
+	}
+	if a.DirectoryURL == "" {
+		a.DirectoryURL = DefaultACMEDirectory
+	}
+	if u, err := url.Parse(a.DirectoryURL); err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, errors.New(fmt.Sprintf("directory_url %s is not an https URL", a.DirectoryURL))
+	}
+	if a.RenewBefore < 0 {
+		return nil, errors.New(fmt.Sprintf("renew_before %v cannot be negative", a.RenewBefore))
+	}
+	if a.RenewBefore == 0 {
+		a.RenewBefore = 30 * 24 * time.Hour
+	}
+	return &a, nil
+}
+
+// parseAdmin checks that the admin API listens on a host:port address with a valid port
+func parseAdmin(raw AdminRawConfig) (*AdminParsedConfig, error) {
+	if raw.Listen == "" {
+		return nil, errors.New("listen is required")
+	}
+	_, portString, err := net.SplitHostPort(raw.Listen)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("listen %s is not a host:port address: %s", raw.Listen, err.Error()))
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil || port < 1 || port > 65535 {
+		return nil, errors.New(fmt.Sprintf("listen %s has an invalid port number", raw.Listen))
+	}
+	return &AdminParsedConfig{Listen: raw.Listen, Port: uint16(port)}, nil
+}
+
+// parseTLSListener turns the TLS version and cipher suite names into their crypto/tls IDs, TLS 1.2 being the minimum
+// version by default. The default certificate can only be left out when ACME is enabled.
+func parseTLSListener(raw TLSListenerRawConfig, acme bool) (TLSListenerParsedConfig, error) {
+	l := TLSListenerParsedConfig{Cert: raw.Cert, Key: raw.Key, MinVersion: tls.VersionTLS12}
+	if (raw.Cert == "") != (raw.Key == "") {
+		return l, errors.New("cert and key go together")
+	}
+	if raw.Cert == "" && !acme {
+		return l, errors.New("cert and key are required unless ACME is enabled")
+	}
+	if raw.MinVersion != "" {
+		version, ok := TLSVersions[raw.MinVersion]
+		if !ok {
+			return l, errors.New(fmt.Sprintf("unknown min_version %s, valid versions are: 1.0, 1.1, 1.2, 1.3", raw.MinVersion))
+		}
+		l.MinVersion = version
+	}
+	for _, name := range raw.CipherSuites {
+		i := slices.IndexFunc(tls.CipherSuites(), func(cs *tls.CipherSuite) bool { return cs.Name == name })
+		if i < 0 {
+			return l, errors.New(fmt.Sprintf("unknown or insecure cipher suite %s", name))
+		}
+		l.CipherSuites = append(l.CipherSuites, tls.CipherSuites()[i].ID)
+	}
+	return l, nil
+}
+
+// SiteTypes lists the kinds of sites
+var SiteTypes = []string{"proxy", "static", "redirect"}
+
+// RedirectPlaceholders lists the request values that a redirect target can use
+var RedirectPlaceholders = []string{"{scheme}", "{host}", "{path}", "{query}", "{uri}"}
+
+var placeholderRegexp = regexp.MustCompile(`\{[^{}]*\}`)
+
+// parseStatic answers with a 200 status and a plain text body by default, and gives the header names their canonical
+// form, so that content_type overrides a Content-Type header however it is spelt
+func parseStatic(raw StaticRawConfig) (*StaticParsedConfig, error) {
+	st := StaticParsedConfig{Status: raw.Status, Body: raw.Body, Headers: map[string]string{}}
+	if st.Status == 0 {
+		st.Status = http.StatusOK
+	}
+	if st.Status < 200 || st.Status > 599 {
+		return nil, errors.New(fmt.Sprintf("status %d is not between 200 and 599", st.Status))
+	}
+	for k, v := range raw.Headers {
+		st.Headers[http.CanonicalHeaderKey(k)] = v
+	}
+	if raw.ContentType != "" {
+		st.Headers["Content-Type"] = raw.ContentType
+	}
+	if _, prs := st.Headers["Content-Type"]; !prs {
+		st.Headers["Content-Type"] = "text/plain; charset=utf-8"
+	}
+	return &st, nil
+}
+
+// parseRedirect sends a 302 status by default, and only takes the redirect statuses and a target whose placeholders are
+// all in RedirectPlaceholders
+func parseRedirect(raw RedirectRawConfig) (*RedirectParsedConfig, error) {
+	rd := RedirectParsedConfig{Status: raw.Status, Target: raw.Target}
+	if rd.Status == 0 {
+		rd.Status = http.StatusFound
+	}
+	if !slices.Contains([]int{http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect}, rd.Status) {
+		return nil, errors.New(fmt.Sprintf("status %d is not one of 301, 302, 307 and 308", rd.Status))
+	}
+	if rd.Target == "" {
+		return nil, errors.New("target is required")
+	}
+	for _, placeholder := range placeholderRegexp.FindAllString(rd.Target, -1) {
+		if !slices.Contains(RedirectPlaceholders, placeholder) {
+			return nil, errors.New(fmt.Sprintf("unknown placeholder %s in target, valid placeholders are: %s", placeholder, strings.Join(RedirectPlaceholders, ", ")))
+		}
+	}
+	return &rd, nil
+}
+
+// Algorithms lists the load balancing algorithms that a site can use
+var Algorithms = []string{"random", "round_robin", "weighted_round_robin", "least_conn", "p2c", "peak_ewma", "ring_hash"}
+
+// parseHashKey turns a hash_key setting into its source and, for headers and cookies, its name
+func parseHashKey(hashKey string) (HashKeyParsedConfig, error) {
+	source, name, hasName := strings.Cut(hashKey, ":")
+	switch source {
+	case "client_ip", "path":
+		if hasName {
+			return HashKeyParsedConfig{}, errors.New(fmt.Sprintf("hash key %s does not take a name", source))
+		}
+		return HashKeyParsedConfig{Source: source}, nil
+	case "header", "cookie":
+		if name == "" {
+			return HashKeyParsedConfig{}, errors.New(fmt.Sprintf("hash key %s needs a name, as in %s:<name>", source, source))
+		}
+		return HashKeyParsedConfig{Source: source, Name: name}, nil
+	}
+	return HashKeyParsedConfig{}, errors.New(fmt.Sprintf("unknown hash key %s, valid hash keys are: client_ip, path, header:<name>, cookie:<name>", hashKey))
 }
 
 // ParsedConfig is the actual configuration that the application uses
@@ -40,6 +991,13 @@ type ParsedConfig struct {
 	ListeningPort uint16
 	LogLevel      uint8
 	Sites         map[string]SiteParsedConfig
+	// TLS holds the settings of the TLS ports
+	TLS  map[uint16]TLSListenerParsedConfig
+	ACME *ACMEParsedConfig
+	// Admin is nil unless the admin API is enabled
+	Admin *AdminParsedConfig
+	// SiteOrder lists the names of the sites in the order of the configuration file
+	SiteOrder []string
 }
 
 // RawConfig is the struct that matches the configuration file
@@ -59,6 +1017,17 @@ func LoadConfig(file string) (*ParsedConfig, error) {
 	if err != nil {
 		return nil, err
 	}
+	// The sites map loses the order of the file, which decides the precedence of regex domains
+	var siteOrder struct {
+		Sites yaml.MapSlice `yaml:"sites"`
+	}
+	err = yaml.Unmarshal(data, &siteOrder)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range siteOrder.Sites {
+		pConfig.SiteOrder = append(pConfig.SiteOrder, fmt.Sprint(item.Key))
+	}
 
 	// Config parsing
 	parsedLogLevel := rConfig.Global.LogLevel
@@ -75,24 +1044,205 @@ func LoadConfig(file string) (*ParsedConfig, error) {
 		return nil, errors.New(fmt.Sprintf("invalid global port number %d", globalPort))
 	}
 	pConfig.ListeningPort = uint16(rConfig.Global.ListeningPort)
+	if rConfig.Global.ACME != nil {
+		acme, err := parseACME(*rConfig.Global.ACME)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid ACME settings: %s", err.Error()))
+		}
+		if len(rConfig.Global.TLS) == 0 {
+			return nil, errors.New("ACME is enabled, but there is no TLS port to use the certificates on")
+		}
+		pConfig.ACME = acme
+	}
+	if rConfig.Global.Admin != nil {
+		admin, err := parseAdmin(*rConfig.Global.Admin)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid admin settings: %s", err.Error()))
+		}
+		pConfig.Admin = admin
+	}
+	for _, listener := range rConfig.Global.TLS {
+		if listener.Port < 1 || listener.Port > 65535 {
+			return nil, errors.New(fmt.Sprintf("TLS port number %d is out of range", listener.Port))
+		}
+		if _, prs := pConfig.TLS[uint16(listener.Port)]; prs {
+			return nil, errors.New(fmt.Sprintf("TLS settings for port %d defined more than once", listener.Port))
+		}
+		parsedListener, err := parseTLSListener(listener, rConfig.Global.ACME != nil)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid TLS settings for port %d: %s", listener.Port, err.Error()))
+		}
+		if pConfig.TLS == nil {
+			pConfig.TLS = map[uint16]TLSListenerParsedConfig{}
+		}
+		pConfig.TLS[uint16(listener.Port)] = parsedListener
+	}
 	pConfig.Sites = make(map[string]SiteParsedConfig)
 	for siteName, siteValue := range rConfig.Sites {
 		var parsedSite SiteParsedConfig
-		for _, endpoint := range siteValue.Endpoints {
-			u, err := url.Parse(endpoint)
+		endpoints, err := parseEndpoints(siteName, siteValue.Endpoints)
+		if err != nil {
+			return nil, err
+		}
+		parsedSite.Endpoints = endpoints
+		if len(siteValue.Groups) > 0 {
+			if len(siteValue.Endpoints) > 0 {
+				return nil, errors.New(fmt.Sprintf("site %s cannot have both endpoints and groups, the endpoints go in the groups", siteName))
+			}
+			groups, err := parseGroups(siteName, siteValue.Groups)
 			if err != nil {
-				// TODO test this
-				return nil, errors.New(fmt.Sprintf("%s is not a valid endpoint: %s", u, err.Error()))
-			} else if err == nil && u.Scheme == "" && u.Host == "" {
-				return nil, errors.New(fmt.Sprintf("%s is not a valid endpoint: endpoints must have a scheme and a host", u))
-			} else if u.Scheme != "http" && u.Scheme != "https" {
-				return nil, errors.New(fmt.Sprintf("%s is not a valid endpoint: lbx only supports HTTP and HTTPS endpoints", u))
+				return nil, err
 			}
-			parsedSite.Endpoints = append(parsedSite.Endpoints, *u)
+			parsedSite.Groups = groups
+		}
+		if sticky := siteValue.GroupSticky; sticky != nil {
+			if len(siteValue.Groups) == 0 {
+				return nil, errors.New(fmt.Sprintf("group_sticky is set for site %s, which has no groups", siteName))
+			}
+			if sticky.Cookie == "" {
+				sticky.Cookie = "lbx_group"
+			}
+			if sticky.MaxAge < 0 {
+				return nil, errors.New(fmt.Sprintf("group sticky max_age %v for site %s cannot be negative", sticky.MaxAge, siteName))
+			}
+			parsedSite.GroupSticky = &GroupStickyParsedConfig{Cookie: sticky.Cookie, MaxAge: sticky.MaxAge}
+		}
+		if siteValue.Type == "" {
+			siteValue.Type = "proxy"
+		}
+		if !slices.Contains(SiteTypes, siteValue.Type) {
+			return nil, errors.New(fmt.Sprintf("unknown type %s for site %s, valid types are: %s", siteValue.Type, siteName, strings.Join(SiteTypes, ", ")))
+		}
+		parsedSite.Type = siteValue.Type
+		if siteValue.Type != "proxy" && (len(siteValue.Endpoints) > 0 || len(siteValue.Groups) > 0) {
+			return nil, errors.New(fmt.Sprintf("%s site %s cannot have endpoints", siteValue.Type, siteName))
+		}
+		for blockType, isSet := range map[string]bool{"static": siteValue.Static != nil, "redirect": siteValue.Redirect != nil} {
+			if isSet && siteValue.Type != blockType {
+				return nil, errors.New(fmt.Sprintf("site %s has a %s block, but its type is %s", siteName, blockType, siteValue.Type))
+			}
+			if !isSet && siteValue.Type == blockType {
+				return nil, errors.New(fmt.Sprintf("%s site %s needs a %s block", blockType, siteName, blockType))
+			}
+		}
+		if siteValue.Static != nil {
+			static, err := parseStatic(*siteValue.Static)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("invalid static for site %s: %s", siteName, err.Error()))
+			}
+			parsedSite.Static = static
+		}
+		if siteValue.Redirect != nil {
+			redirect, err := parseRedirect(*siteValue.Redirect)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("invalid redirect for site %s: %s", siteName, err.Error()))
+			}
+			parsedSite.Redirect = redirect
+		}
+		if m := siteValue.Maintenance; m != nil {
+			if m.RetryAfter < 0 {
+				return nil, errors.New(fmt.Sprintf("maintenance retry_after %v for site %s cannot be negative", m.RetryAfter, siteName))
+			}
+			if m.ContentType == "" {
+				m.ContentType = "text/html; charset=utf-8"
+			}
+			parsedSite.Maintenance = &MaintenanceParsedConfig{Enabled: m.Enabled, Body: m.Body, ContentType: m.ContentType, RetryAfter: m.RetryAfter}
+		}
+		if siteValue.TLS != nil {
+			if siteValue.TLS.Cert == "" || siteValue.TLS.Key == "" {
+				return nil, errors.New(fmt.Sprintf("the TLS settings of site %s need both a cert and a key", siteName))
+			}
+			parsedSite.TLS = &SiteTLSParsedConfig{Cert: siteValue.TLS.Cert, Key: siteValue.TLS.Key}
+		}
+		if siteValue.Mirror != nil {
+			mirror, err := parseMirror(*siteValue.Mirror, parsedSite.Groups)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("invalid mirror for site %s: %s", siteName, err.Error()))
+			}
+			parsedSite.Mirror = mirror
 		}
 
 		parsedSite.RefreshPeriod = siteValue.CheckPeriod
+		if siteValue.Algorithm == "" {
+			siteValue.Algorithm = "random"
+		}
+		if !slices.Contains(Algorithms, siteValue.Algorithm) {
+			return nil, errors.New(fmt.Sprintf("unknown algorithm %s for site %s, valid algorithms are: %s", siteValue.Algorithm, siteName, strings.Join(Algorithms, ", ")))
+		}
+		parsedSite.Algorithm = siteValue.Algorithm
+		if siteValue.Algorithm == "ring_hash" && siteValue.HashKey == "" {
+			siteValue.HashKey = "client_ip"
+		}
+		if siteValue.HashKey != "" && siteValue.Algorithm != "ring_hash" {
+			return nil, errors.New(fmt.Sprintf("site %s has a hash_key, but only the ring_hash algorithm uses it, not %s", siteName, siteValue.Algorithm))
+		}
+		if siteValue.HashKey != "" {
+			hashKey, err := parseHashKey(siteValue.HashKey)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("invalid hash_key for site %s: %s", siteName, err.Error()))
+			}
+			parsedSite.HashKey = hashKey
+		}
+		if sticky := siteValue.StickySession; sticky != nil {
+			if sticky.Cookie == "" {
+				sticky.Cookie = stickyCookieName(siteName)
+			}
+			if sticky.MaxAge < 0 {
+				return nil, errors.New(fmt.Sprintf("sticky session max_age %v for site %s cannot be negative", sticky.MaxAge, siteName))
+			}
+			parsedSite.StickySession = &StickySessionParsedConfig{Cookie: sticky.Cookie, Secret: sticky.Secret, MaxAge: sticky.MaxAge}
+		}
+		healthCheck, err := parseHealthCheck(siteValue.HealthCheck)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid health_check for site %s: %s", siteName, err.Error()))
+		}
+		parsedSite.HealthCheck = healthCheck
+		if siteValue.OutlierDetection != nil {
+			outlierDetection, err := parseOutlierDetection(*siteValue.OutlierDetection)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("invalid outlier_detection for site %s: %s", siteName, err.Error()))
+			}
+			parsedSite.OutlierDetection = outlierDetection
+		}
+		if siteValue.ResponseTimeout < 0 {
+			return nil, errors.New(fmt.Sprintf("response_timeout %v for site %s cannot be negative", siteValue.ResponseTimeout, siteName))
+		}
+		parsedSite.ResponseTimeout = siteValue.ResponseTimeout
+		if agent := siteValue.AgentCheck; agent != nil {
+			if agent.Port < 1 || agent.Port > 65535 {
+				return nil, errors.New(fmt.Sprintf("agent check port number %d is out of range for site %s", agent.Port, siteName))
+			}
+			if agent.Timeout < 0 {
+				return nil, errors.New(fmt.Sprintf("agent check timeout %v for site %s cannot be negative", agent.Timeout, siteName))
+			}
+			if agent.Timeout == 0 {
+				agent.Timeout = 2 * time.Second
+			}
+			parsedSite.AgentCheck = &AgentCheckParsedConfig{Port: uint16(agent.Port), Send: agent.Send, Timeout: agent.Timeout}
+		}
+		if siteValue.Match != nil {
+			match, err := parseMatch(*siteValue.Match)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("invalid match for site %s: %s", siteName, err.Error()))
+			}
+			parsedSite.Match = match
+		}
+		parsedSite.StripPrefix = parsePathPrefix(siteValue.StripPrefix)
+		parsedSite.AddPrefix = parsePathPrefix(siteValue.AddPrefix)
+		for _, rule := range siteValue.Rewrite {
+			if rule.Regex == "" {
+				return nil, errors.New(fmt.Sprintf("rewrite rule without a regex for site %s", siteName))
+			}
+			re, err := regexp.Compile(rule.Regex)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("invalid rewrite rule for site %s: %s", siteName, err.Error()))
+			}
+			parsedSite.Rewrite = append(parsedSite.Rewrite, RewriteParsedConfig{Regex: re, Replacement: rule.Replacement})
+		}
 		if siteName == "default" {
+			if siteValue.Fallback {
+				return nil, errors.New(fmt.Sprintf("site default cannot be a fallback site, it already serves the requests for every host on port %d", rConfig.Global.ListeningPort))
+			}
 			parsedSite.Domain = ""
 			parsedSite.Path = "/*"
 			parsedSite.Port = uint16(rConfig.Global.ListeningPort)
@@ -120,7 +1270,12 @@ func LoadConfig(file string) (*ParsedConfig, error) {
 				siteValue.Path = "/" + siteValue.Path
 			}
 			parsedSite.Path = siteValue.Path
-			parsedSite.Domain = siteValue.Domain
+			domain, err := parseDomain(siteValue.Domain)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("invalid domain for site %s: %s", siteName, err.Error()))
+			}
+			parsedSite.Domain = domain
+			parsedSite.Fallback = siteValue.Fallback
 			sitePort := siteValue.Port
 			if sitePort < 1 || sitePort > 65535 {
 				return nil, errors.New(fmt.Sprintf("port number %d is out of range for site %s", sitePort, siteName))
@@ -128,6 +1283,12 @@ func LoadConfig(file string) (*ParsedConfig, error) {
 			parsedSite.Port = uint16(sitePort)
 			parsedSite.RefreshPeriod = siteValue.CheckPeriod
 		}
+		if siteValue.HealthCheck.Jitter == nil {
+			parsedSite.HealthCheck.Jitter = parsedSite.RefreshPeriod / 10
+		}
+		if siteValue.HealthCheck.MaxInterval == 0 {
+			parsedSite.HealthCheck.MaxInterval = parsedSite.RefreshPeriod * 8
+		}
 		_, prs := pConfig.Sites[siteName]
 		if prs {
 			return nil, errors.New(fmt.Sprintf("site %s defined more than once in %s", siteName, file))
@@ -135,6 +1296,61 @@ func LoadConfig(file string) (*ParsedConfig, error) {
 		pConfig.Sites[siteName] = parsedSite
 	}
 
+	fallbacks := map[uint16]string{}
+	siteNames := make([]string, 0, len(pConfig.Sites))
+	for siteName := range pConfig.Sites {
+		siteNames = append(siteNames, siteName)
+	}
+	slices.Sort(siteNames)
+	for _, siteName := range siteNames {
+		parsedSite := pConfig.Sites[siteName]
+		if !parsedSite.Fallback {
+			continue
+		}
+		if other, prs := fallbacks[parsedSite.Port]; prs {
+			return nil, errors.New(fmt.Sprintf("sites %s and %s are both the fallback of port %d", other, siteName, parsedSite.Port))
+		}
+		fallbacks[parsedSite.Port] = siteName
+	}
+	if pConfig.Admin != nil {
+		// The sites listen on every address of their port
+		for _, siteName := range siteNames {
+			if pConfig.Sites[siteName].Port == pConfig.Admin.Port {
+				return nil, errors.New(fmt.Sprintf("admin port %d is already used by site %s", pConfig.Admin.Port, siteName))
+			}
+		}
+	}
+
+	// Certificates are chosen by domain, so the sites of a domain have to agree on theirs
+	certificates := map[uint16]map[string]string{}
+	tlsPorts := map[uint16]bool{}
+	for _, siteName := range siteNames {
+		parsedSite := pConfig.Sites[siteName]
+		_, isTLS := pConfig.TLS[parsedSite.Port]
+		tlsPorts[parsedSite.Port] = isTLS
+		if parsedSite.TLS == nil {
+			continue
+		}
+		if !isTLS {
+			return nil, errors.New(fmt.Sprintf("site %s has a certificate, but port %d has no TLS settings", siteName, parsedSite.Port))
+		}
+		if parsedSite.Domain == "" {
+			return nil, errors.New(fmt.Sprintf("site %s has a certificate, but no domain to choose it by", siteName))
+		}
+		if certificates[parsedSite.Port] == nil {
+			certificates[parsedSite.Port] = map[string]string{}
+		}
+		if other, prs := certificates[parsedSite.Port][parsedSite.Domain]; prs && *pConfig.Sites[other].TLS != *parsedSite.TLS {
+			return nil, errors.New(fmt.Sprintf("sites %s and %s have different certificates for domain %s on port %d", other, siteName, parsedSite.Domain, parsedSite.Port))
+		}
+		certificates[parsedSite.Port][parsedSite.Domain] = siteName
+	}
+	for port := range pConfig.TLS {
+		if !tlsPorts[port] {
+			return nil, errors.New(fmt.Sprintf("TLS settings for port %d, which no site uses", port))
+		}
+	}
+
 	return &pConfig, nil
 }
 
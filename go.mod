@@ -3,8 +3,20 @@ module github.com/L1Cafe/lbx
 go 1.21
 
 require (
-	github.com/google/uuid v1.3.1
+	github.com/google/uuid v1.6.0
 	gopkg.in/yaml.v2 v2.4.0
 )
 
-require github.com/go-chi/chi/v5 v5.0.10 // indirect
+require (
+	github.com/go-chi/chi/v5 v5.0.10
+	golang.org/x/crypto v0.26.0
+	google.golang.org/grpc v1.67.1
+)
+
+require (
+	golang.org/x/net v0.28.0 // indirect
+	golang.org/x/sys v0.24.0 // indirect
+	golang.org/x/text v0.17.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240814211410-ddb44dafa142 // indirect
+	google.golang.org/protobuf v1.34.2 // indirect
+)
@@ -0,0 +1,161 @@
+package site
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/L1Cafe/lbx/config"
+	"github.com/L1Cafe/lbx/log"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeManager obtains and renews the certificates of the ACME domains, it is nil unless ACME is enabled
+var acmeManager *autocert.Manager
+
+// acmeCancel makes the ACME requests of acmeManager fail, so that Stop doesn't wait for the certificates in progress
+var acmeCancel context.CancelFunc
+
+// isACMEDomain tells whether a site domain can get a certificate through ACME. Wildcard certificates need the DNS-01
+// challenge, and regex domains name no host at all.
+func isACMEDomain(domain string) bool {
+	return domain != "" && !strings.HasPrefix(domain, "*.") && !strings.HasPrefix(domain, "~")
+}
+
+// acmeDomains lists the exact domains of the sites on a TLS port that have no certificate of their own
+func acmeDomains(routes *portRoutes) []string {
+	var domains []string
+	for _, domain := range routes.domainOrder {
+		if !isACMEDomain(domain) {
+			continue
+		}
+		ownCertificate := false
+		for _, pathSites := range routes.domains[domain] {
+			for _, s := range pathSites {
+				ownCertificate = ownCertificate || s.tls != nil
+			}
+		}
+		if !ownCertificate {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+// orderLocations fills in the order URL of the finalize responses that don't carry it, as Pebble does, since the ACME
+// client polls the order at that URL until the certificate is issued. The order URLs are learnt from the responses
+// that create the orders, which tell both URLs. As autocert gives no context to the ACME flow that a certificate starts
+// with, the requests fail once ctx is done instead.
+type orderLocations struct {
+	transport http.RoundTripper
+	ctx       context.Context
+	mutex     sync.Mutex
+	// orders maps the finalize URLs to their order URLs
+	orders map[string]string
+}
+
+func (ol *orderLocations) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := ol.ctx.Err(); err != nil {
+		return nil, err
+	}
+	res, err := ol.transport.RoundTrip(req)
+	if err != nil || req.Method != http.MethodPost {
+		return res, err
+	}
+	location := res.Header.Get("Location")
+	if location == "" {
+		ol.mutex.Lock()
+		if orderURL, ok := ol.orders[req.URL.String()]; ok {
+			res.Header.Set("Location", orderURL)
+			delete(ol.orders, req.URL.String())
+		}
+		ol.mutex.Unlock()
+		return res, nil
+	}
+	if res.StatusCode != http.StatusCreated {
+		return res, nil
+	}
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return res, nil
+	}
+	var order struct {
+		Finalize string `json:"finalize"`
+	}
+	if json.Unmarshal(body, &order) == nil && order.Finalize != "" {
+		ol.mutex.Lock()
+		ol.orders[order.Finalize] = location
+		ol.mutex.Unlock()
+	}
+	return res, nil
+}
+
+// acmeHTTPClient trusts the system roots and the roots of the CA cert file, if there is one. Its requests fail once
+// ctx is done.
+func acmeHTTPClient(ctx context.Context, caCert string) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if caCert != "" {
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(caCert)
+		if err != nil {
+			return nil, err
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, errors.New(fmt.Sprintf("no certificate found in %s", caCert))
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	}
+	return &http.Client{Transport: &orderLocations{transport: transport, ctx: ctx, orders: map[string]string{}}}, nil
+}
+
+// newACMEManager creates the manager that obtains the certificates of domains. The certificates and the account key
+// are kept in the cache directory, and are renewed in the background while lbx runs. Its ACME requests fail once ctx
+// is done.
+func newACMEManager(ctx context.Context, conf *config.ACMEParsedConfig, domains []string) (*autocert.Manager, error) {
+	httpClient, err := acmeHTTPClient(ctx, conf.CACert)
+	if err != nil {
+		return nil, fmt.Errorf("loading the ACME CA certificate %s: %w", conf.CACert, err)
+	}
+	return &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Cache:       autocert.DirCache(conf.CacheDir),
+		HostPolicy:  autocert.HostWhitelist(domains...),
+		RenewBefore: conf.RenewBefore,
+		Email:       conf.Email,
+		Client:      &acme.Client{DirectoryURL: conf.DirectoryURL, HTTPClient: httpClient},
+	}, nil
+}
+
+// obtainCertificate makes sure that the manager has a certificate for domain, so that the first client of the domain
+// doesn't wait for the whole ACME flow. The certificate is requested as for a client that supports ECDSA, like the
+// clients that will get it.
+func obtainCertificate(manager *autocert.Manager, domain string) bool {
+	hello := &tls.ClientHelloInfo{ServerName: domain, CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}}
+	if _, err := manager.GetCertificate(hello); err != nil {
+		log.Wrapper(log.Warn, fmt.Sprintf("Could not obtain a certificate for domain %s, it will be requested again on the first handshake: %s", domain, err.Error()))
+		return false
+	}
+	log.Wrapper(log.Info, fmt.Sprintf("Certificate for domain %s is ready", domain))
+	return true
+}
+
+// isACMEChallenge tells whether a handshake comes from an ACME server checking a TLS-ALPN-01 challenge
+func isACMEChallenge(hello *tls.ClientHelloInfo) bool {
+	return slices.Contains(hello.SupportedProtos, acme.ALPNProto)
+}
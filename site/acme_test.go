@@ -0,0 +1,186 @@
+package site
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/L1Cafe/lbx/config"
+)
+
+func TestACMEDomains(t *testing.T) {
+	shop := routedSite(t, "shop", "shop.example.com", "/*")
+	shop.tls = &config.SiteTLSParsedConfig{Cert: "shop.crt", Key: "shop.key"}
+	routes := &portRoutes{
+		domains: map[string]pathSiteMap{
+			"shop.example.com":    {"/*": {shop}},
+			"*.apps.example.com":  {"/*": {routedSite(t, "apps", "*.apps.example.com", "/*")}},
+			"~.*\\.example\\.org": {"/*": {routedSite(t, "org", "~.*\\.example\\.org", "/*")}},
+			"":                    {"/*": {routedSite(t, "any", "", "/*")}},
+			"plain.example.com":   {"/*": {routedSite(t, "plain", "plain.example.com", "/*")}},
+		},
+		domainOrder: []string{"shop.example.com", "*.apps.example.com", "~.*\\.example\\.org", "", "plain.example.com"},
+	}
+	if got := acmeDomains(routes); !slices.Equal(got, []string{"plain.example.com"}) {
+		t.Errorf("Expected only plain.example.com to get an ACME certificate, got %v", got)
+	}
+}
+
+func TestACMEWithoutDefaultCertificate(t *testing.T) {
+	dir := t.TempDir()
+	shopCert, shopKey := writeTestCertificate(t, dir, "shop", "shop.example.com")
+	shop := routedSite(t, "shop", "shop.example.com", "/*")
+	shop.tls = &config.SiteTLSParsedConfig{Cert: shopCert, Key: shopKey}
+	routes := &portRoutes{domains: map[string]pathSiteMap{"shop.example.com": {"/*": {shop}}}, domainOrder: []string{"shop.example.com"}}
+	manager, err := newACMEManager(context.Background(), &config.ACMEParsedConfig{DirectoryURL: "https://acme.invalid/directory", CacheDir: dir}, nil)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	acmeManager = manager
+	t.Cleanup(func() { acmeManager = nil })
+	cs, err := newCertificateStore(config.TLSListenerParsedConfig{MinVersion: tls.VersionTLS12}, routes, newPortRouter(routes))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if _, err := cs.getCertificate(&tls.ClientHelloInfo{ServerName: "shop.example.com"}); err != nil {
+		t.Errorf("Expected the certificate of shop.example.com, got %s", err)
+	}
+	if _, err := cs.getCertificate(&tls.ClientHelloInfo{ServerName: "unknown.example.com"}); err == nil {
+		t.Error("Expected an error for a server name without a certificate and no default certificate")
+	}
+}
+
+func TestOrderLocations(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/new-order":
+			w.Header().Set("Location", "https://ca.example.com/order/1")
+			w.WriteHeader(http.StatusCreated)
+			_, _ = io.WriteString(w, `{"status":"pending","finalize":"https://ca.example.com/finalize/1"}`)
+		default:
+			_, _ = io.WriteString(w, `{"status":"processing"}`)
+		}
+	}))
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client, err := acmeHTTPClient(ctx, "")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	ol := client.Transport.(*orderLocations)
+	res, err := client.Post(server.URL+"/new-order", "application/jose+json", nil)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if !strings.Contains(string(body), "finalize") {
+		t.Errorf("Expected the order body to be left intact, got %s", body)
+	}
+	if got := ol.orders["https://ca.example.com/finalize/1"]; got != "https://ca.example.com/order/1" {
+		t.Errorf("Expected the order URL to be learnt, got %q", got)
+	}
+	// The finalize URL of the test server stands for the one of the order
+	ol.orders[server.URL+"/finalize/1"] = "https://ca.example.com/order/1"
+	res, err = client.Post(server.URL+"/finalize/1", "application/jose+json", nil)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	res.Body.Close()
+	if got := res.Header.Get("Location"); got != "https://ca.example.com/order/1" {
+		t.Errorf("Expected the finalize response to get the order URL, got %q", got)
+	}
+	if _, ok := ol.orders[server.URL+"/finalize/1"]; ok {
+		t.Error("Expected the order URL to be forgotten once the order is finalized")
+	}
+
+	cancel()
+	if _, err := client.Post(server.URL+"/new-order", "application/jose+json", nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the ACME requests to fail once the context is canceled, got %v", err)
+	}
+}
+
+// TestACMEPebble obtains a certificate from a Pebble instance, set PEBBLE_DIRECTORY_URL to run it. PEBBLE_CA_CERT is
+// the root certificate of the Pebble API, PEBBLE_DOMAIN the domain to get the certificate for, which Pebble must
+// resolve to this host, and PEBBLE_HTTP_PORT and PEBBLE_TLS_PORT the ports that Pebble validates the challenges on.
+func TestACMEPebble(t *testing.T) {
+	directoryURL := os.Getenv("PEBBLE_DIRECTORY_URL")
+	if directoryURL == "" {
+		t.Skip("PEBBLE_DIRECTORY_URL is not set")
+	}
+	env := func(name string, fallback string) string {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+		return fallback
+	}
+	domain := env("PEBBLE_DOMAIN", "lbx.localhost")
+	manager, err := newACMEManager(context.Background(), &config.ACMEParsedConfig{
+		DirectoryURL: directoryURL,
+		CacheDir:     t.TempDir(),
+		CACert:       os.Getenv("PEBBLE_CA_CERT"),
+		RenewBefore:  24 * time.Hour,
+	}, []string{domain})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	acmeManager = manager
+	t.Cleanup(func() { acmeManager = nil })
+	routes := &portRoutes{domains: map[string]pathSiteMap{domain: {"/*": {routedSite(t, "pebble", domain, "/*")}}}, domainOrder: []string{domain}}
+	router := newPortRouter(routes)
+	listener := config.TLSListenerParsedConfig{MinVersion: tls.VersionTLS12}
+	cs, err := newCertificateStore(listener, routes, router)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	start := func(port string, handler http.Handler, tlsConfig *tls.Config) {
+		l, err := net.Listen("tcp", ":"+port)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		server := httptest.NewUnstartedServer(handler)
+		server.Listener = l
+		if tlsConfig != nil {
+			server.TLS = tlsConfig
+			server.StartTLS()
+		} else {
+			server.Start()
+		}
+		t.Cleanup(server.Close)
+	}
+	start(env("PEBBLE_HTTP_PORT", "5002"), manager.HTTPHandler(router), nil)
+	tlsPort := env("PEBBLE_TLS_PORT", "5001")
+	start(tlsPort, router, newTLSConfig(listener, cs))
+
+	// The certificate is obtained ahead of the first handshake, and cached for the ECDSA clients
+	if !obtainCertificate(manager, domain) {
+		t.Fatalf("Could not obtain a certificate for %s", domain)
+	}
+	if _, err := manager.Cache.Get(context.Background(), domain); err != nil {
+		t.Errorf("Expected the certificate of %s to be cached: %s", domain, err)
+	}
+
+	// The issuer of Pebble changes on every start, so the chain is checked for the domain only
+	conn, err := tls.Dial("tcp", net.JoinHostPort("127.0.0.1", tlsPort), &tls.Config{ServerName: domain, InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer conn.Close()
+	leaf := conn.ConnectionState().PeerCertificates[0]
+	if err := leaf.VerifyHostname(domain); err != nil {
+		t.Errorf("Expected a certificate for %s: %s", domain, err)
+	}
+	if leaf.Issuer.String() == leaf.Subject.String() {
+		t.Errorf("Expected a certificate issued by Pebble, got a self-signed one")
+	}
+}
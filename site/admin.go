@@ -0,0 +1,137 @@
+package site
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/L1Cafe/lbx/log"
+	"github.com/go-chi/chi/v5"
+)
+
+// newAdminRouter serves the runtime controls of the sites:
+//   - POST /sites/{site}/check queues a health check of every endpoint of the site
+//   - POST /sites/{site}/endpoints/check?url={url} queues a health check of one endpoint of the site
+//   - PUT /sites/{site}/groups changes the weights of the endpoint groups of the site, from a JSON object such as
+//     {"stable": 90, "canary": 10}
+//   - PUT /sites/{site}/maintenance puts the site in maintenance mode or takes it out of it, from a JSON object such as
+//     {"enabled": true}
+//   - GET /sites/{site}/mirror returns the mirroring counters of the site as a JSON object
+//   - GET /explain?port={port}&host={host}&path={path} tells which site serves a host and a path on a port
+func newAdminRouter() *chi.Mux {
+	r := chi.NewRouter()
+	r.Put("/sites/{site}/groups", func(w http.ResponseWriter, r *http.Request) {
+		name, ok := adminSite(w, r)
+		if !ok {
+			return
+		}
+		var weights map[string]uint
+		if err := json.NewDecoder(r.Body).Decode(&weights); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid group weights: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
+		adminReply(w, SetGroupWeights(name, weights), http.StatusNoContent)
+	})
+	r.Put("/sites/{site}/maintenance", func(w http.ResponseWriter, r *http.Request) {
+		name, ok := adminSite(w, r)
+		if !ok {
+			return
+		}
+		var maintenance struct {
+			Enabled *bool `json:"enabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&maintenance); err != nil || maintenance.Enabled == nil {
+			http.Error(w, `Expected a JSON object such as {"enabled": true}`, http.StatusBadRequest)
+			return
+		}
+		adminReply(w, SetMaintenance(name, *maintenance.Enabled), http.StatusNoContent)
+	})
+	r.Get("/sites/{site}/mirror", func(w http.ResponseWriter, r *http.Request) {
+		name, ok := adminSite(w, r)
+		if !ok {
+			return
+		}
+		stats, err := SiteMirrorStats(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(stats)
+	})
+	r.Get("/explain", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		port, err := strconv.ParseUint(query.Get("port"), 10, 16)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid port %q", query.Get("port")), http.StatusBadRequest)
+			return
+		}
+		path := query.Get("path")
+		if path == "" {
+			path = "/"
+		}
+		explanation, err := ExplainHost(uint16(port), query.Get("host"), path)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = io.WriteString(w, explanation)
+	})
+	r.Post("/sites/{site}/check", func(w http.ResponseWriter, r *http.Request) {
+		name, ok := adminSite(w, r)
+		if !ok {
+			return
+		}
+		adminReply(w, CheckSite(name), http.StatusAccepted)
+	})
+	r.Post("/sites/{site}/endpoints/check", func(w http.ResponseWriter, r *http.Request) {
+		name, ok := adminSite(w, r)
+		if !ok {
+			return
+		}
+		endpoint := r.URL.Query().Get("url")
+		if endpoint == "" {
+			http.Error(w, "The url query parameter is required", http.StatusBadRequest)
+			return
+		}
+		adminReply(w, CheckEndpoint(name, endpoint), http.StatusAccepted)
+	})
+	return r
+}
+
+// adminSite returns the name of the site of an admin request, or answers with a 404 when there is no such site
+func adminSite(w http.ResponseWriter, r *http.Request) (string, bool) {
+	name := chi.URLParam(r, "site")
+	if _, err := lookupSite(name); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return "", false
+	}
+	return name, true
+}
+
+// adminReply answers an admin request with status when the control succeeded, and with the error otherwise
+func adminReply(w http.ResponseWriter, err error, status int) {
+	switch {
+	case err == nil:
+		w.WriteHeader(status)
+	case errors.Is(err, errQueueFull):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// startAdminServer serves the admin API until the graceful shutdown. Intended to be run as goroutine, after adding it
+// to runningGoroutines.
+func startAdminServer(srv *http.Server) {
+	defer runningGoroutines.Done()
+	err := srv.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Wrapper(log.Fatal, fmt.Sprintf("Error starting admin server on %s: %s", srv.Addr, err))
+	}
+	log.Wrapper(log.Info, fmt.Sprintf("Graceful shutdown requested, terminating admin server on %s...", srv.Addr))
+}
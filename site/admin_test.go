@@ -0,0 +1,173 @@
+package site
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/L1Cafe/lbx/config"
+)
+
+func TestAdminHealthChecks(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+	s := newSite("admin_test", config.SiteParsedConfig{
+		Endpoints:     []config.EndpointParsedConfig{{URL: *u, Weight: 1}},
+		RefreshPeriod: time.Hour,
+		Path:          "/*",
+		HealthCheck:   config.DefaultHealthCheck(),
+	})
+	sites = map[string]*site{"admin_test": s}
+	healthCheckQueue = make(chan healthCheckJob, 1)
+	pendingChecks = map[healthCheckJob]bool{}
+	defer func() { sites, healthCheckQueue, pendingChecks = nil, nil, nil }()
+
+	admin := newAdminRouter()
+	post := func(target string) int {
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest(http.MethodPost, target, nil))
+		return w.Code
+	}
+	for _, c := range []struct {
+		target string
+		status int
+	}{
+		{"/sites/does_not_exist/check", http.StatusNotFound},
+		{"/sites/admin_test/check", http.StatusAccepted},
+		// The same check isn't queued twice
+		{"/sites/admin_test/check", http.StatusAccepted},
+		{"/sites/admin_test/endpoints/check", http.StatusBadRequest},
+		{"/sites/admin_test/endpoints/check?url=" + url.QueryEscape("http://localhost:1"), http.StatusBadRequest},
+		// The queue only has room for the check of the whole site
+		{"/sites/admin_test/endpoints/check?url=" + url.QueryEscape(upstream.URL), http.StatusServiceUnavailable},
+	} {
+		if status := post(c.target); status != c.status {
+			t.Errorf("Expected status %d for POST %s, got %d", c.status, c.target, status)
+		}
+	}
+	if len(healthCheckQueue) != 1 {
+		t.Errorf("Expected 1 check in the queue, got %d", len(healthCheckQueue))
+	}
+}
+
+func TestAdminExplain(t *testing.T) {
+	s := newSite("explain_test", config.SiteParsedConfig{Domain: "*.example.com", Path: "/*", Port: 8080})
+	portMap = map[uint16]*portRoutes{8080: {
+		domains:     map[string]pathSiteMap{"*.example.com": {"/*": {s}}},
+		domainOrder: []string{"*.example.com"},
+	}}
+	defer func() { portMap = nil }()
+
+	admin := newAdminRouter()
+	for _, c := range []struct {
+		target string
+		status int
+		want   string
+	}{
+		{"/explain?port=8080&host=www.example.com", http.StatusOK, "Path / is served by site explain_test"},
+		{"/explain?port=8080&host=example.com&path=/x", http.StatusOK, "No site serves path /x"},
+		{"/explain?port=8081&host=www.example.com", http.StatusNotFound, "no site listens on port 8081"},
+		{"/explain?port=http&host=www.example.com", http.StatusBadRequest, "Invalid port"},
+	} {
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest(http.MethodGet, c.target, nil))
+		if w.Code != c.status || !strings.Contains(w.Body.String(), c.want) {
+			t.Errorf("Expected status %d and %q for GET %s, got %d and %q", c.status, c.want, c.target, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestAdminGroupWeights(t *testing.T) {
+	u, _ := url.Parse("http://localhost:1")
+	s := newSite("admin_groups_test", config.SiteParsedConfig{
+		Path: "/*",
+		Groups: []config.EndpointGroupParsedConfig{
+			{Name: "stable", Weight: 90, Endpoints: []config.EndpointParsedConfig{{URL: *u, Weight: 1}}},
+			{Name: "canary", Weight: 10, Endpoints: []config.EndpointParsedConfig{{URL: *u, Weight: 1}}},
+		},
+	})
+	sites = map[string]*site{"admin_groups_test": s}
+	defer func() { sites = nil }()
+
+	admin := newAdminRouter()
+	for _, c := range []struct {
+		body   string
+		status int
+	}{
+		{`{"canary": 0}`, http.StatusNoContent},
+		{`{"beta": 5}`, http.StatusBadRequest},
+		{`{"stable": 0}`, http.StatusBadRequest},
+		{`{"stable": -1}`, http.StatusBadRequest},
+		{`stable=5`, http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/sites/admin_groups_test/groups", strings.NewReader(c.body)))
+		if w.Code != c.status {
+			t.Errorf("Expected status %d for the group weights %s, got %d", c.status, c.body, w.Code)
+		}
+	}
+	if stable, canary := s.groups[0].weight.Load(), s.groups[1].weight.Load(); stable != 90 || canary != 0 {
+		t.Errorf("Expected the weights 90 and 0, got %d and %d", stable, canary)
+	}
+}
+
+func TestAdminMirrorStats(t *testing.T) {
+	u, _ := url.Parse("http://localhost:1")
+	s := readySite(t, "admin_mirror_test", config.SiteParsedConfig{
+		Path: "/*",
+		Groups: []config.EndpointGroupParsedConfig{
+			{Name: "live", Weight: 1, Endpoints: []config.EndpointParsedConfig{{URL: *u, Weight: 1}}},
+			{Name: "shadow", Weight: 0, Endpoints: []config.EndpointParsedConfig{{URL: *u, Weight: 1}}},
+		},
+		Mirror: &config.MirrorParsedConfig{Group: "shadow", Percent: 100},
+	})
+	readySite(t, "admin_no_mirror_test", config.SiteParsedConfig{Path: "/*"})
+	s.mirror.mirrored.Add(3)
+	s.mirror.bodyMismatches.Add(1)
+
+	admin := newAdminRouter()
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/sites/admin_mirror_test/mirror", nil))
+	var stats MirrorStats
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+		t.Fatalf("Invalid mirroring counters: %s", err)
+	}
+	if want := (MirrorStats{Mirrored: 3, BodyMismatches: 1}); stats != want {
+		t.Errorf("Expected the mirroring counters %+v, got %+v", want, stats)
+	}
+	w = httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/sites/admin_no_mirror_test/mirror", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected a 404 for the mirroring counters of a site that doesn't mirror requests, got %d", w.Code)
+	}
+}
+
+func TestAdminMaintenance(t *testing.T) {
+	s := readySite(t, "admin_maintenance_test", config.SiteParsedConfig{Path: "/*"})
+
+	admin := newAdminRouter()
+	for _, c := range []struct {
+		body          string
+		status        int
+		inMaintenance bool
+	}{
+		{`{"enabled": true}`, http.StatusNoContent, true},
+		{`{}`, http.StatusBadRequest, true},
+		{`{"enabled": "no"}`, http.StatusBadRequest, true},
+		{`{"enabled": false}`, http.StatusNoContent, false},
+	} {
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/sites/admin_maintenance_test/maintenance", strings.NewReader(c.body)))
+		if w.Code != c.status {
+			t.Errorf("Expected status %d for the maintenance mode %s, got %d", c.status, c.body, w.Code)
+		}
+		if s.inMaintenance.Load() != c.inMaintenance {
+			t.Errorf("Expected the maintenance mode to be %v after %s", c.inMaintenance, c.body)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package site
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/L1Cafe/lbx/log"
+)
+
+// maxAgentReply is the longest agent reply that is read
+const maxAgentReply = 512
+
+// maxAgentWeightPercent is the highest weight that an agent can report, as in HAProxy. It keeps an agent from making
+// the ring of a ring hash site grow without bounds.
+const maxAgentWeightPercent = 256
+
+// agentState is what the agent of an endpoint last reported. The agent can only take an endpoint out of rotation or
+// change its weight, the health checks still decide whether it is healthy.
+type agentState struct {
+	mutex sync.Mutex
+	// down is set by "down", "failed" and "stopped", and cleared by "up"
+	down bool
+	// maint is set by "maint", and cleared by "ready"
+	maint bool
+	// drain is set by "drain", and cleared by "ready"
+	drain bool
+	// reply is the last reply, so that only changes are logged
+	reply string
+}
+
+// available tells whether the agent allows the endpoint to get new traffic
+func (a *agentState) available() bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return !a.down && !a.maint && !a.drain
+}
+
+// draining tells whether the agent only allows the endpoint to keep the clients pinned to it by sticky sessions
+func (a *agentState) draining() bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return !a.down && !a.maint && a.drain
+}
+
+// applyAgentReply updates the agent state and the weight of the endpoint from an agent reply, and returns the words
+// that it skipped. Words are separated by spaces, tabs or commas, and anything after "#" is a description. Unknown
+// words, such as the "maxconn:30" of HAProxy agents, are skipped. An empty reply or an oversized weight is an error, and
+// leaves the endpoint unchanged.
+func (e *endpoint) applyAgentReply(reply string) ([]string, error) {
+	reply, _, _ = strings.Cut(reply, "#")
+	words := strings.FieldsFunc(reply, func(r rune) bool { return r == ' ' || r == '\t' || r == ',' })
+	if len(words) == 0 {
+		return nil, errors.New("empty agent reply")
+	}
+	a := &e.agent
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	down, maint, drain := a.down, a.maint, a.drain
+	weightPercent := e.weightPercent.Load()
+	var skipped []string
+	for _, word := range words {
+		switch strings.ToLower(word) {
+		case "up":
+			down = false
+		case "down", "failed", "stopped":
+			down = true
+		case "maint":
+			maint = true
+		case "drain":
+			drain = true
+		case "ready":
+			maint, drain = false, false
+		default:
+			percent, isPercent := strings.CutSuffix(word, "%")
+			p, err := strconv.ParseUint(percent, 10, 32)
+			if !isPercent || err != nil {
+				skipped = append(skipped, word)
+				continue
+			}
+			if p > maxAgentWeightPercent {
+				return nil, fmt.Errorf("weight %s in agent reply is above %d%%", word, maxAgentWeightPercent)
+			}
+			weightPercent = uint32(p)
+		}
+	}
+	a.down, a.maint, a.drain = down, maint, drain
+	e.weightPercent.Store(weightPercent)
+	return skipped, nil
+}
+
+// queryAgent connects to the agent port of the endpoint host, sends the configured string, and returns the first line
+// of the reply
+func (s *site) queryAgent(e *endpoint) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.agentCheck.Timeout)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(e.url.Hostname(), strconv.Itoa(int(s.agentCheck.Port))))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetDeadline(deadline)
+	if s.agentCheck.Send != "" {
+		if _, err := io.WriteString(conn, s.agentCheck.Send); err != nil {
+			return "", err
+		}
+	}
+	line, err := bufio.NewReader(io.LimitReader(conn, maxAgentReply)).ReadString('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// pollAgent asks the agent of the endpoint for its state. When the agent can't be reached, the last reported state
+// is kept.
+func (s *site) pollAgent(e *endpoint) {
+	reply, err := s.queryAgent(e)
+	if err != nil {
+		log.Wrapper(log.Info, fmt.Sprintf("Agent check of endpoint %s for site %s failed, keeping the last reported state: %s", e.url.String(), s.name, err.Error()))
+		return
+	}
+	e.agent.mutex.Lock()
+	changed := e.agent.reply != reply
+	e.agent.reply = reply
+	e.agent.mutex.Unlock()
+	skipped, err := e.applyAgentReply(reply)
+	if err != nil {
+		log.Wrapper(log.Warn, fmt.Sprintf("Ignoring the agent reply of endpoint %s for site %s: %s", e.url.String(), s.name, err.Error()))
+		return
+	}
+	if changed {
+		if len(skipped) > 0 {
+			log.Wrapper(log.Warn, fmt.Sprintf("Agent of endpoint %s for site %s reported unknown words %s, skipping them", e.url.String(), s.name, strings.Join(skipped, ", ")))
+		}
+		log.Wrapper(log.Info, fmt.Sprintf("Agent of endpoint %s for site %s reported %q, weight is now %d%% and the endpoint is %s", e.url.String(), s.name, reply, e.weightPercent.Load(), availability(&e.agent)))
+	}
+}
+
+func availability(a *agentState) string {
+	if a.available() {
+		return "available"
+	}
+	if a.draining() {
+		return "draining, only its sticky clients reach it"
+	}
+	return "out of rotation"
+}
@@ -0,0 +1,104 @@
+package site
+
+import (
+	"bufio"
+	"net"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/L1Cafe/lbx/config"
+)
+
+func TestApplyAgentReply(t *testing.T) {
+	u, _ := url.Parse("http://a:80")
+	e := newEndpoint(*u, 2)
+	if _, err := e.applyAgentReply("up 50%"); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if !e.agent.available() || e.effectiveWeight() != 100 {
+		t.Errorf("Expected an available endpoint at half weight, got available=%v weight=%d", e.agent.available(), e.effectiveWeight())
+	}
+	if _, err := e.applyAgentReply("drain # rolling restart"); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if e.agent.available() {
+		t.Error("A drained endpoint is still available")
+	}
+	if _, err := e.applyAgentReply("ready,100%"); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if !e.agent.available() || e.effectiveWeight() != 200 {
+		t.Errorf("Expected the endpoint to be back at full weight, got available=%v weight=%d", e.agent.available(), e.effectiveWeight())
+	}
+	skipped, err := e.applyAgentReply("down maxconn:30 sideways")
+	if err != nil {
+		t.Fatalf("An agent reply with unknown words was rejected: %s", err)
+	}
+	if !slices.Equal(skipped, []string{"maxconn:30", "sideways"}) {
+		t.Errorf("Expected the unknown words to be skipped, got %q", skipped)
+	}
+	if e.agent.available() {
+		t.Error("The unknown words of an agent reply kept the rest of the reply from being applied")
+	}
+	if _, err := e.applyAgentReply("up"); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if _, err := e.applyAgentReply("100000000%"); err == nil {
+		t.Error("An agent reply with an oversized weight was accepted")
+	}
+	if e.effectiveWeight() != 200 {
+		t.Errorf("An oversized weight changed the weight of the endpoint to %d", e.effectiveWeight())
+	}
+}
+
+func TestPollAgent(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer l.Close()
+	replies := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			request, _ := bufio.NewReader(conn).ReadString('\n')
+			if request == "status\n" {
+				_, _ = conn.Write([]byte(<-replies + "\n"))
+			}
+			_ = conn.Close()
+		}
+	}()
+	port := l.Addr().(*net.TCPAddr).Port
+	u, _ := url.Parse("http://127.0.0.1:1")
+	s := newSite("agent_test", config.SiteParsedConfig{
+		Endpoints:     []config.EndpointParsedConfig{{URL: *u, Weight: 1}},
+		RefreshPeriod: time.Second,
+		AgentCheck:    &config.AgentCheckParsedConfig{Port: uint16(port), Send: "status\n", Timeout: time.Second},
+	})
+	e := s.endpoints[0]
+	e.health.recordCheck(nil, s.healthCheck)
+
+	replies <- "maint"
+	s.pollAgent(e)
+	s.updateHealthyEndpoints()
+	if len(*s.healthyEndpoints.endpoints) != 0 {
+		t.Error("An endpoint in maintenance is still in the healthy endpoints")
+	}
+	replies <- "ready 25%"
+	s.pollAgent(e)
+	s.updateHealthyEndpoints()
+	if len(*s.healthyEndpoints.endpoints) != 1 || e.effectiveWeight() != 25 {
+		t.Errorf("Expected the endpoint to be back at a quarter of its weight, got weight %d", e.effectiveWeight())
+	}
+	// An unreachable agent leaves the endpoint as it was
+	l.Close()
+	s.pollAgent(e)
+	if !e.agent.available() || e.effectiveWeight() != 25 {
+		t.Error("An unreachable agent changed the state of the endpoint")
+	}
+}
@@ -0,0 +1,181 @@
+package site
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/L1Cafe/lbx/config"
+)
+
+var errNoEndpoints = errors.New("no endpoints to choose from")
+
+// Balancer chooses the endpoint that serves a request. It is handed the current list of healthy endpoints of a site
+// on every call, as that list is swapped by the health checks at any time. Implementations must be safe for
+// concurrent use.
+type Balancer interface {
+	Next(endpoints []*endpoint, r *http.Request) (*endpoint, error)
+}
+
+// newBalancer returns the Balancer for the algorithm of a site, as validated by config.LoadConfig
+func newBalancer(conf config.SiteParsedConfig) Balancer {
+	switch conf.Algorithm {
+	case "round_robin":
+		return new(roundRobinBalancer)
+	case "weighted_round_robin":
+		return newWeightedRoundRobinBalancer()
+	case "least_conn":
+		return leastConnBalancer{}
+	case "p2c":
+		return powerOfTwoBalancer{}
+	case "peak_ewma":
+		return peakEwmaBalancer{}
+	case "ring_hash":
+		return newRingHashBalancer(conf.HashKey)
+	default:
+		return randomBalancer{}
+	}
+}
+
+// randomBalancer chooses an endpoint at random
+type randomBalancer struct{}
+
+func (randomBalancer) Next(endpoints []*endpoint, _ *http.Request) (*endpoint, error) {
+	if len(endpoints) < 1 {
+		return nil, errNoEndpoints
+	}
+	return endpoints[rand.Intn(len(endpoints))], nil
+}
+
+// roundRobinBalancer goes through the endpoints in order
+type roundRobinBalancer struct {
+	counter atomic.Uint64
+}
+
+func (b *roundRobinBalancer) Next(endpoints []*endpoint, _ *http.Request) (*endpoint, error) {
+	if len(endpoints) < 1 {
+		return nil, errNoEndpoints
+	}
+	n := b.counter.Add(1) - 1
+	return endpoints[n%uint64(len(endpoints))], nil
+}
+
+// weightedRoundRobinBalancer is the smooth weighted round-robin used by nginx. On every pick, each endpoint's current
+// weight grows by its effective weight, the endpoint with the highest current weight is chosen, and the sum of all
+// weights is subtracted from it. This spreads the picks of heavy endpoints evenly instead of sending them in bursts.
+// Current weights are kept per endpoint, so they survive the healthy endpoints list being swapped.
+type weightedRoundRobinBalancer struct {
+	mutex   sync.Mutex
+	current map[*endpoint]int
+}
+
+func newWeightedRoundRobinBalancer() *weightedRoundRobinBalancer {
+	return &weightedRoundRobinBalancer{current: map[*endpoint]int{}}
+}
+
+func (b *weightedRoundRobinBalancer) Next(endpoints []*endpoint, _ *http.Request) (*endpoint, error) {
+	if len(endpoints) < 1 {
+		return nil, errNoEndpoints
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	total := 0
+	var best *endpoint
+	for _, e := range endpoints {
+		w := int(e.effectiveWeight())
+		b.current[e] += w
+		total += w
+		if best == nil || b.current[e] > b.current[best] {
+			best = e
+		}
+	}
+	b.current[best] -= total
+	if len(b.current) > len(endpoints) {
+		// Endpoints that left the healthy list start from scratch when they come back
+		for e := range b.current {
+			if !slices.Contains(endpoints, e) {
+				delete(b.current, e)
+			}
+		}
+	}
+	return best, nil
+}
+
+// leastConnBalancer chooses the endpoint with the fewest requests in flight. The scan starts at a random offset so
+// that ties don't always go to the first endpoint of the list.
+type leastConnBalancer struct{}
+
+func (leastConnBalancer) Next(endpoints []*endpoint, _ *http.Request) (*endpoint, error) {
+	if len(endpoints) < 1 {
+		return nil, errNoEndpoints
+	}
+	offset := rand.Intn(len(endpoints))
+	best := endpoints[offset]
+	for i := 1; i < len(endpoints); i++ {
+		e := endpoints[(offset+i)%len(endpoints)]
+		if e.inFlight.Load() < best.inFlight.Load() {
+			best = e
+		}
+	}
+	return best, nil
+}
+
+// powerOfTwoBalancer picks two endpoints at random and chooses the one with the fewest requests in flight. It gets
+// close to least connections without scanning the whole list, and avoids every balancer sending its traffic to the
+// same idle endpoint at once.
+type powerOfTwoBalancer struct{}
+
+func (powerOfTwoBalancer) Next(endpoints []*endpoint, _ *http.Request) (*endpoint, error) {
+	if len(endpoints) < 1 {
+		return nil, errNoEndpoints
+	}
+	if len(endpoints) == 1 {
+		return endpoints[0], nil
+	}
+	i := rand.Intn(len(endpoints))
+	j := rand.Intn(len(endpoints) - 1)
+	if j >= i {
+		j++
+	}
+	if endpoints[j].inFlight.Load() < endpoints[i].inFlight.Load() {
+		return endpoints[j], nil
+	}
+	return endpoints[i], nil
+}
+
+// unobservedPenalty is the cost given to an endpoint that has requests in flight but no latency observations yet, so
+// that a new endpoint doesn't get flooded before its first response comes back
+const unobservedPenalty = float64(time.Second)
+
+// peakEwmaBalancer chooses the endpoint with the lowest latency average multiplied by the requests in flight. Slow
+// endpoints get less traffic without being taken out of rotation.
+type peakEwmaBalancer struct{}
+
+func ewmaScore(e *endpoint) float64 {
+	cost := e.latency.value()
+	inFlight := float64(e.inFlight.Load())
+	if cost == 0 && inFlight > 0 {
+		return unobservedPenalty + inFlight
+	}
+	return cost * (inFlight + 1)
+}
+
+func (peakEwmaBalancer) Next(endpoints []*endpoint, _ *http.Request) (*endpoint, error) {
+	if len(endpoints) < 1 {
+		return nil, errNoEndpoints
+	}
+	offset := rand.Intn(len(endpoints))
+	best := endpoints[offset]
+	bestScore := ewmaScore(best)
+	for i := 1; i < len(endpoints); i++ {
+		e := endpoints[(offset+i)%len(endpoints)]
+		if score := ewmaScore(e); score < bestScore {
+			best, bestScore = e, score
+		}
+	}
+	return best, nil
+}
@@ -0,0 +1,180 @@
+package site
+
+import (
+	"fmt"
+	"github.com/L1Cafe/lbx/config"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func testEndpoints(t *testing.T, rawURLs ...string) []*endpoint {
+	t.Helper()
+	var endpoints []*endpoint
+	for _, r := range rawURLs {
+		u, err := url.Parse(r)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		endpoints = append(endpoints, newEndpoint(*u, 1))
+	}
+	return endpoints
+}
+
+func TestRoundRobinBalancer(t *testing.T) {
+	endpoints := testEndpoints(t, "http://a:80", "http://b:80", "http://c:80")
+	b := newBalancer(config.SiteParsedConfig{Algorithm: "round_robin"})
+	for i := 0; i < 9; i++ {
+		e, err := b.Next(endpoints, nil)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		if e != endpoints[i%3] {
+			t.Errorf("Request %d: expected %s, got %s", i, endpoints[i%3].url.String(), e.url.String())
+		}
+	}
+	// The list of healthy endpoints shrinking must not cause out of range errors
+	if _, err := b.Next(endpoints[:1], nil); err != nil {
+		t.Errorf("%s", err)
+	}
+	if _, err := b.Next(nil, nil); err == nil {
+		t.Error("Expected an error when there are no endpoints to choose from")
+	}
+}
+
+func TestRandomBalancer(t *testing.T) {
+	endpoints := testEndpoints(t, "http://a:80", "http://b:80")
+	b := newBalancer(config.SiteParsedConfig{Algorithm: "random"})
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		e, err := b.Next(endpoints, nil)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		seen[e.url.Host] = true
+	}
+	if len(seen) != 2 {
+		t.Errorf("Expected both endpoints to be chosen at least once in 100 requests, got %v", seen)
+	}
+}
+
+func TestWeightedRoundRobinBalancer(t *testing.T) {
+	endpoints := testEndpoints(t, "http://a:80", "http://b:80", "http://c:80")
+	endpoints[0].weight = 5
+	b := newBalancer(config.SiteParsedConfig{Algorithm: "weighted_round_robin"})
+	var sequence string
+	for i := 0; i < 7; i++ {
+		e, err := b.Next(endpoints, nil)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		sequence += e.url.Hostname()
+	}
+	// Same sequence as nginx for weights 5, 1, 1
+	if sequence != "aabacaa" {
+		t.Errorf("Unexpected weighted round-robin sequence %s", sequence)
+	}
+	// Swapping the healthy list must keep the proportions of the remaining endpoints
+	counts := map[string]int{}
+	for i := 0; i < 60; i++ {
+		e, _ := b.Next(endpoints[:2], nil)
+		counts[e.url.Hostname()]++
+	}
+	if counts["a"] != 50 || counts["b"] != 10 {
+		t.Errorf("Expected a 5:1 split between a and b, got %v", counts)
+	}
+}
+
+func TestLeastConnBalancers(t *testing.T) {
+	endpoints := testEndpoints(t, "http://a:80", "http://b:80", "http://c:80")
+	endpoints[0].inFlight.Store(4)
+	endpoints[1].inFlight.Store(1)
+	endpoints[2].inFlight.Store(7)
+	for i := 0; i < 20; i++ {
+		e, err := newBalancer(config.SiteParsedConfig{Algorithm: "least_conn"}).Next(endpoints, nil)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		if e != endpoints[1] {
+			t.Errorf("Expected the endpoint with the fewest requests in flight, got %s", e.url.String())
+		}
+	}
+	for i := 0; i < 50; i++ {
+		e, err := newBalancer(config.SiteParsedConfig{Algorithm: "p2c"}).Next(endpoints, nil)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		if e == endpoints[2] {
+			t.Error("Power of two choices picked the busiest endpoint")
+		}
+	}
+}
+
+func TestPeakEwmaBalancer(t *testing.T) {
+	endpoints := testEndpoints(t, "http://fast:80", "http://slow:80")
+	endpoints[0].latency.observe(10 * time.Millisecond)
+	endpoints[1].latency.observe(200 * time.Millisecond)
+	b := newBalancer(config.SiteParsedConfig{Algorithm: "peak_ewma"})
+	e, _ := b.Next(endpoints, nil)
+	if e != endpoints[0] {
+		t.Errorf("Expected the fast endpoint to be chosen, got %s", e.url.String())
+	}
+	// Enough requests in flight on the fast endpoint make the slow one the better choice
+	endpoints[0].inFlight.Store(30)
+	e, _ = b.Next(endpoints, nil)
+	if e != endpoints[1] {
+		t.Errorf("Expected the slow endpoint to be chosen when the fast one is busy, got %s", e.url.String())
+	}
+	// A single slow response is enough to raise the average to the peak
+	endpoints[0].inFlight.Store(0)
+	endpoints[0].latency.observe(time.Second)
+	e, _ = b.Next(endpoints, nil)
+	if e != endpoints[1] {
+		t.Errorf("Expected the endpoint with the lowest peak latency to be chosen, got %s", e.url.String())
+	}
+	// An endpoint that fails fast is not the cheapest choice
+	failing := testEndpoints(t, "http://failing:80", "http://working:80")
+	failing[0].latency.observeFailure()
+	failing[1].latency.observe(200 * time.Millisecond)
+	e, _ = b.Next(failing, nil)
+	if e != failing[1] {
+		t.Errorf("Expected the endpoint that answers to be chosen over the failing one, got %s", e.url.String())
+	}
+}
+
+func TestRingHashBalancer(t *testing.T) {
+	endpoints := testEndpoints(t, "http://a:80", "http://b:80", "http://c:80", "http://d:80")
+	b := newBalancer(config.SiteParsedConfig{Algorithm: "ring_hash", HashKey: config.HashKeyParsedConfig{Source: "header", Name: "X-User"}})
+	pick := func(endpoints []*endpoint, user string) *endpoint {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-User", user)
+		e, err := b.Next(endpoints, r)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		return e
+	}
+	before := map[string]*endpoint{}
+	for i := 0; i < 1000; i++ {
+		user := fmt.Sprintf("user-%d", i)
+		before[user] = pick(endpoints, user)
+		if pick(endpoints, user) != before[user] {
+			t.Fatalf("The same key was sent to two different endpoints")
+		}
+	}
+	// Evicting one endpoint must only move the keys that it owned
+	moved := 0
+	for user, e := range before {
+		after := pick(endpoints[:3], user)
+		if e != endpoints[3] && after != e {
+			t.Fatalf("Key %s moved from %s to %s although its endpoint is still healthy", user, e.url.Host, after.url.Host)
+		}
+		if after != e {
+			moved++
+		}
+	}
+	if moved < 150 || moved > 350 {
+		t.Errorf("Expected about a quarter of the keys to move, %d out of 1000 did", moved)
+	}
+}
@@ -0,0 +1,145 @@
+package site
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/L1Cafe/lbx/config"
+	"github.com/L1Cafe/lbx/log"
+)
+
+// endpointGroup is a named set of endpoints of a site, such as a stable or a canary release. Each group has its own
+// balancer, and its weight can be changed at runtime with SetGroupWeights.
+type endpointGroup struct {
+	name     string
+	weight   atomic.Uint32
+	balancer Balancer
+}
+
+// groupSticky keeps a client in the group it was first sent to with a cookie that names the group. The cookie isn't
+// signed, as choosing a group is something a client is allowed to do.
+type groupSticky struct {
+	cookie string
+	maxAge int
+}
+
+func newGroupSticky(conf *config.GroupStickyParsedConfig) *groupSticky {
+	return &groupSticky{cookie: conf.Cookie, maxAge: int(conf.MaxAge.Seconds())}
+}
+
+// newCookie returns the cookie that keeps the client in group g
+func (gs *groupSticky) newCookie(g *endpointGroup, r *http.Request) *http.Cookie {
+	return &http.Cookie{
+		Name:     gs.cookie,
+		Value:    g.name,
+		Path:     "/",
+		MaxAge:   gs.maxAge,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// pinnedGroup is the group named by the cookie of the request, or the empty string
+func (gs *groupSticky) pinnedGroup(r *http.Request) string {
+	c, err := r.Cookie(gs.cookie)
+	if err != nil {
+		return ""
+	}
+	return c.Value
+}
+
+// chooseGroup picks the group that serves the request among the groups with healthy endpoints and a weight above 0,
+// and returns its healthy endpoints. A client that the cookie pins to one of them stays there, the others are spread
+// by weight.
+func (s *site) chooseGroup(healthy []*endpoint, r *http.Request) (*endpointGroup, []*endpoint) {
+	members := map[*endpointGroup][]*endpoint{}
+	for _, e := range healthy {
+		members[e.group] = append(members[e.group], e)
+	}
+	var total uint64
+	var candidates []*endpointGroup
+	for _, g := range s.groups {
+		if w := g.weight.Load(); w > 0 && len(members[g]) > 0 {
+			candidates = append(candidates, g)
+			total += uint64(w)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+	if s.groupSticky != nil {
+		if name := s.groupSticky.pinnedGroup(r); name != "" {
+			for _, g := range candidates {
+				if g.name == name {
+					return g, members[g]
+				}
+			}
+		}
+	}
+	n := uint64(rand.Int63n(int64(total)))
+	for _, g := range candidates {
+		w := uint64(g.weight.Load())
+		if n < w {
+			return g, members[g]
+		}
+		n -= w
+	}
+	// The weights changed while the group was being picked
+	g := candidates[len(candidates)-1]
+	return g, members[g]
+}
+
+// SetGroupWeights changes the share of requests that the endpoint groups of a site get, without a restart. The
+// groups that aren't listed keep their weight, and at least one group of the site needs a weight above 0. Clients
+// pinned to a group by group_sticky, or to one of its endpoints by sticky_session, stay there, unless its weight drops
+// to 0.
+func SetGroupWeights(name string, weights map[string]uint) error {
+	s, err := lookupSite(name)
+	if err != nil {
+		return err
+	}
+	if len(s.groups) == 0 {
+		return errors.New(fmt.Sprintf("site %s has no endpoint groups", name))
+	}
+	for groupName := range weights {
+		if !s.hasGroup(groupName) {
+			return errors.New(fmt.Sprintf("site %s has no endpoint group %s", name, groupName))
+		}
+	}
+	var total uint
+	for _, g := range s.groups {
+		w, listed := weights[g.name]
+		if !listed {
+			w = uint(g.weight.Load())
+		}
+		total += w
+	}
+	if total == 0 {
+		return errors.New(fmt.Sprintf("at least one endpoint group of site %s needs a weight above 0", name))
+	}
+	var split []string
+	for _, g := range s.groups {
+		if w, listed := weights[g.name]; listed {
+			g.weight.Store(uint32(w))
+		}
+		split = append(split, fmt.Sprintf("%s=%d", g.name, g.weight.Load()))
+	}
+	sort.Strings(split)
+	log.Wrapper(log.Info, fmt.Sprintf("Endpoint group weights of site %s are now %s", name, strings.Join(split, ", ")))
+	return nil
+}
+
+func (s *site) hasGroup(name string) bool {
+	for _, g := range s.groups {
+		if g.name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+package site
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/L1Cafe/lbx/config"
+)
+
+func TestEndpointGroups(t *testing.T) {
+	var groups []config.EndpointGroupParsedConfig
+	for _, group := range []struct {
+		name   string
+		weight uint
+	}{{"stable", 90}, {"canary", 10}} {
+		name := group.name
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, name)
+		}))
+		defer upstream.Close()
+		u, _ := url.Parse(upstream.URL)
+		groups = append(groups, config.EndpointGroupParsedConfig{Name: name, Weight: group.weight, Endpoints: []config.EndpointParsedConfig{{URL: *u, Weight: 1}}})
+	}
+	s := newSite("groups_test", config.SiteParsedConfig{
+		RefreshPeriod: time.Second,
+		Path:          "/*",
+		Algorithm:     "round_robin",
+		HealthCheck:   config.DefaultHealthCheck(),
+		Groups:        groups,
+		GroupSticky:   &config.GroupStickyParsedConfig{Cookie: "lbx_group"},
+	})
+	for _, e := range s.endpoints {
+		e.health.recordCheck(nil, s.healthCheck)
+	}
+	s.updateHealthyEndpoints()
+	sites = map[string]*site{"groups_test": s}
+	defer func() { sites = nil }()
+
+	serve := func(group string) (string, *http.Cookie) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if group != "" {
+			r.AddCookie(&http.Cookie{Name: "lbx_group", Value: group})
+		}
+		w := httptest.NewRecorder()
+		siteHandler(s)(w, r)
+		var cookie *http.Cookie
+		for _, c := range w.Result().Cookies() {
+			if c.Name == "lbx_group" {
+				cookie = c
+			}
+		}
+		return w.Body.String(), cookie
+	}
+
+	canary := 0
+	for i := 0; i < 2000; i++ {
+		served, cookie := serve("")
+		if cookie == nil || cookie.Value != served {
+			t.Fatalf("Expected a cookie naming group %s, got %v", served, cookie)
+		}
+		if served == "canary" {
+			canary++
+		}
+	}
+	if canary < 100 || canary > 300 {
+		t.Errorf("Expected about 10%% of 2000 requests to reach the canary group, got %d", canary)
+	}
+	for i := 0; i < 20; i++ {
+		if served, cookie := serve("canary"); served != "canary" || cookie != nil {
+			t.Fatalf("Expected a client pinned to the canary group to stay there without a new cookie, got %s", served)
+		}
+	}
+
+	// A site can pin clients to an endpoint as well as split its traffic between groups
+	sticky := newSite("sticky_groups_test", config.SiteParsedConfig{
+		RefreshPeriod: time.Second,
+		Path:          "/*",
+		Algorithm:     "round_robin",
+		HealthCheck:   config.DefaultHealthCheck(),
+		Groups:        groups,
+		StickySession: &config.StickySessionParsedConfig{Cookie: "lbx_sticky_sticky_groups_test", Secret: "secret"},
+	})
+	for _, e := range sticky.endpoints {
+		e.health.recordCheck(nil, sticky.healthCheck)
+	}
+	sticky.updateHealthyEndpoints()
+	sites["sticky_groups_test"] = sticky
+	var canaryEndpoint *endpoint
+	for _, e := range sticky.endpoints {
+		if e.group.name == "canary" {
+			canaryEndpoint = e
+		}
+	}
+	servePinned := func() (string, *http.Cookie) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.AddCookie(sticky.sticky.newCookie(canaryEndpoint, r))
+		w := httptest.NewRecorder()
+		siteHandler(sticky)(w, r)
+		var cookie *http.Cookie
+		for _, c := range w.Result().Cookies() {
+			if c.Name == "lbx_sticky_sticky_groups_test" {
+				cookie = c
+			}
+		}
+		return w.Body.String(), cookie
+	}
+	if served, cookie := servePinned(); served != "canary" || cookie != nil {
+		t.Fatalf("Expected a client pinned to the canary endpoint to stay there without a new cookie, got %s", served)
+	}
+	if err := SetGroupWeights("sticky_groups_test", map[string]uint{"canary": 0}); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if served, cookie := servePinned(); served != "stable" || cookie == nil {
+		t.Errorf("Expected a client pinned to the canary endpoint to be moved to the stable group with a new cookie once the canary weight is 0, got %s", served)
+	}
+
+	if err := SetGroupWeights("groups_test", map[string]uint{"canary": 0}); err != nil {
+		t.Fatalf("%s", err)
+	}
+	for i := 0; i < 20; i++ {
+		if served, _ := serve("canary"); served != "stable" {
+			t.Fatalf("Expected every request to reach the stable group once the canary weight is 0, got %s", served)
+		}
+	}
+	if err := SetGroupWeights("groups_test", map[string]uint{"stable": 0}); err == nil {
+		t.Error("Expected an error when every group has a weight of 0")
+	}
+	if err := SetGroupWeights("groups_test", map[string]uint{"beta": 5}); err == nil {
+		t.Error("Expected an error for an unknown group")
+	}
+	if err := SetGroupWeights("does_not_exist", map[string]uint{"stable": 5}); err == nil {
+		t.Error("Expected an error for an unknown site")
+	}
+}
@@ -0,0 +1,38 @@
+package site
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/url"
+
+	"github.com/L1Cafe/lbx/config"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// grpcCheck calls grpc.health.v1.Health/Check on the endpoint over HTTP/2, and only accepts the SERVING status.
+// Plain http endpoints are reached over h2c.
+func grpcCheck(u url.URL, hc config.HealthCheckParsedConfig) error {
+	creds := insecure.NewCredentials()
+	if u.Scheme == "https" {
+		creds = credentials.NewTLS(&tls.Config{ServerName: u.Hostname()})
+	}
+	conn, err := grpc.NewClient("passthrough:///"+checkAddress(u, hc), grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), hc.Timeout)
+	defer cancel()
+	res, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: hc.Service})
+	if err != nil {
+		return err
+	}
+	if res.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("service %q of %s is %s", hc.Service, u.String(), res.GetStatus())
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package site
+
+import (
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/L1Cafe/lbx/config"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestGrpcCheck(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	srv := grpc.NewServer()
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("payments", healthpb.HealthCheckResponse_NOT_SERVING)
+	healthpb.RegisterHealthServer(srv, healthServer)
+	go func() { _ = srv.Serve(l) }()
+	defer srv.Stop()
+
+	u, _ := url.Parse("http://" + l.Addr().String())
+	hc := config.DefaultHealthCheck()
+	hc.Type = "grpc"
+	hc.Timeout = 2 * time.Second
+	if err := grpcCheck(*u, hc); err != nil {
+		t.Errorf("Expected the server to be SERVING, got %s", err)
+	}
+	hc.Service = "payments"
+	if err := grpcCheck(*u, hc); err == nil {
+		t.Error("A NOT_SERVING service was accepted as healthy")
+	}
+	healthServer.SetServingStatus("payments", healthpb.HealthCheckResponse_SERVING)
+	if err := grpcCheck(*u, hc); err != nil {
+		t.Errorf("Expected the payments service to be SERVING, got %s", err)
+	}
+	hc.Service = "unknown"
+	if err := grpcCheck(*u, hc); err == nil {
+		t.Error("An unknown service was accepted as healthy")
+	}
+}
@@ -0,0 +1,370 @@
+package site
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/L1Cafe/lbx/config"
+	"github.com/L1Cafe/lbx/log"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type healthState uint8
+
+const (
+	// stateUnhealthy endpoints get no traffic
+	stateUnhealthy healthState = iota
+	// stateRecovering endpoints are unhealthy endpoints that passed some checks, but not enough to be healthy again
+	stateRecovering
+	// stateHealthy endpoints get traffic
+	stateHealthy
+	// stateEjected endpoints were evicted for failing live requests. Their checks are ignored until the ejection time
+	// ends, after which they recover like unhealthy endpoints.
+	stateEjected
+)
+
+func (hs healthState) String() string {
+	switch hs {
+	case stateUnhealthy:
+		return "unhealthy"
+	case stateRecovering:
+		return "recovering"
+	case stateHealthy:
+		return "healthy"
+	case stateEjected:
+		return "ejected"
+	default:
+		return strconv.Itoa(int(hs))
+	}
+}
+
+// endpointHealth is the health state of an endpoint, along with the streak of check results that leads to the next
+// transition
+type endpointHealth struct {
+	mutex     sync.Mutex
+	state     healthState
+	checked   bool
+	successes uint
+	failures  uint
+	// passiveFailures is the streak of failed live requests
+	passiveFailures uint
+	ejectedUntil    time.Time
+	lastEjection    time.Time
+	// ejections is the number of recent ejections, which the ejection time grows with
+	ejections uint
+	// nextCheck is when an endpoint that keeps failing is checked again, the zero value means at the next period
+	nextCheck time.Time
+}
+
+// recordCheck applies the result of a check to the health state, and returns the state before and after it. The first
+// check decides the state on its own, so that endpoints don't wait for several periods before getting traffic after a
+// start.
+func (h *endpointHealth) recordCheck(checkErr error, hc config.HealthCheckParsedConfig) (from healthState, to healthState, first bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	from = h.state
+	first = !h.checked
+	if h.state == stateEjected {
+		if time.Now().Before(h.ejectedUntil) {
+			return from, h.state, first
+		}
+		h.state = stateUnhealthy
+		h.successes = 0
+	}
+	if checkErr == nil {
+		h.successes++
+		h.failures = 0
+	} else {
+		h.failures++
+		h.successes = 0
+	}
+	switch {
+	case !h.checked && checkErr == nil:
+		h.state = stateHealthy
+	case !h.checked:
+		h.state = stateUnhealthy
+	case checkErr == nil && h.state != stateHealthy && h.successes >= hc.HealthyThreshold:
+		h.state = stateHealthy
+	case checkErr == nil && h.state == stateUnhealthy:
+		h.state = stateRecovering
+	case checkErr != nil && h.state == stateRecovering:
+		h.state = stateUnhealthy
+	case checkErr != nil && h.state == stateHealthy && h.failures >= hc.UnhealthyThreshold:
+		h.state = stateUnhealthy
+	}
+	h.checked = true
+	return from, h.state, first
+}
+
+// scheduleNextCheck backs off the checks of an unhealthy endpoint, doubling the interval with every failed check after
+// the one that made it unhealthy, up to maxInterval
+func (h *endpointHealth) scheduleNextCheck(period time.Duration, maxInterval time.Duration, unhealthyThreshold uint) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.state != stateUnhealthy || h.failures <= unhealthyThreshold || maxInterval <= period {
+		h.nextCheck = time.Time{}
+		return
+	}
+	interval := period << min(h.failures-unhealthyThreshold, 16)
+	if interval > maxInterval || interval <= 0 {
+		interval = maxInterval
+	}
+	h.nextCheck = time.Now().Add(interval)
+}
+
+// dueForCheck tells whether the endpoint should be checked in the current period
+func (h *endpointHealth) dueForCheck(now time.Time) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.state == stateEjected && now.Before(h.ejectedUntil) {
+		return false
+	}
+	return !now.Before(h.nextCheck)
+}
+
+func (h *endpointHealth) current() healthState {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.state
+}
+
+// checkEndpoint runs the health check of the site against one endpoint, and logs the state transition it causes
+func (s *site) checkEndpoint(e *endpoint) {
+	log.Wrapper(log.Info, fmt.Sprintf("Checking health status of endpoint %s for site %s", e.url.String(), s.name))
+	err := s.probe(e)
+	if s.agentCheck != nil {
+		s.pollAgent(e)
+	}
+	from, to, first := e.health.recordCheck(err, s.healthCheck)
+	e.health.scheduleNextCheck(s.refreshPeriod, s.healthCheck.MaxInterval, s.healthCheck.UnhealthyThreshold)
+	reason := "check passed"
+	level := log.Info
+	if err != nil {
+		reason = err.Error()
+	}
+	if to == stateUnhealthy {
+		level = log.Warn
+	}
+	if first {
+		log.Wrapper(level, fmt.Sprintf("Endpoint %s of site %s is %s after its first check: %s", e.url.String(), s.name, to, reason))
+	} else if from != to {
+		log.Wrapper(level, fmt.Sprintf("Endpoint %s of site %s went from %s to %s: %s", e.url.String(), s.name, from, to, reason))
+	}
+}
+
+// updateHealthyEndpoints swaps the list of healthy endpoints with the endpoints that are currently in the healthy state,
+// leaving out the ones that their agent took out of rotation. The ones that their agent drains are kept apart for
+// their sticky clients.
+func (s *site) updateHealthyEndpoints() {
+	currentHealthyEndpoints := new([]*endpoint)
+	var draining []*endpoint
+	for _, e := range s.endpoints {
+		if e.health.current() != stateHealthy || e.effectiveWeight() == 0 {
+			continue
+		}
+		if e.agent.available() {
+			*currentHealthyEndpoints = append(*currentHealthyEndpoints, e)
+		} else if e.agent.draining() {
+			draining = append(draining, e)
+		}
+	}
+	s.healthyEndpoints.mutex.Lock()
+	s.healthyEndpoints.endpoints = currentHealthyEndpoints
+	s.healthyEndpoints.draining = draining
+	s.healthyEndpoints.mutex.Unlock()
+}
+
+// checkEndpoints checks endpoints in parallel, with no more checks at the same time than the concurrency of the site
+// allows, and returns once all of them are done
+func (s *site) checkEndpoints(endpoints []*endpoint) {
+	concurrency := max(s.healthCheck.Concurrency, 1)
+	semaphore := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, e := range endpoints {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(e *endpoint) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			s.checkEndpoint(e)
+		}(e)
+	}
+	wg.Wait()
+}
+
+// nextPeriod is the check period of the site plus a random jitter, so that sites with the same period spread their
+// checks over time instead of all firing at once
+func (s *site) nextPeriod() time.Duration {
+	if s.healthCheck.Jitter <= 0 {
+		return s.refreshPeriod
+	}
+	return s.refreshPeriod + time.Duration(rand.Int63n(int64(s.healthCheck.Jitter)))
+}
+
+// autoHealthCheck periodically checks the endpoints in the provided site name. Intended to be run as goroutine.
+func (s *site) autoHealthCheck() {
+	runningGoroutines.Add(1)
+	for {
+		log.Wrapper(log.Info, fmt.Sprintf("Checking healthy endpoints for site %s", s.name))
+		now := time.Now()
+		var due []*endpoint
+		for _, endpoint := range s.endpoints {
+			if endpoint.health.dueForCheck(now) {
+				due = append(due, endpoint)
+			}
+		}
+		s.checkEndpoints(due)
+		s.updateHealthyEndpoints()
+		log.Wrapper(log.Info, fmt.Sprintf("Healthy endpoint list of site %s was updated", s.name))
+		select {
+
+		case <-gracefulShutdownChannel:
+			// Channel was closed
+			log.Wrapper(log.Info, fmt.Sprintf("Graceful shutdown requested, terminating %v healthchecks...", s.name))
+			defer runningGoroutines.Done()
+			return
+		case <-time.After(s.nextPeriod()):
+			// Do nothing, just wait		return
+		}
+	}
+}
+
+// probe runs the health check of the type configured for the site against an endpoint
+func (s *site) probe(e *endpoint) error {
+	switch s.healthCheck.Type {
+	case "tcp":
+		return tcpCheck(e.url, s.healthCheck)
+	case "grpc":
+		return grpcCheck(e.url, s.healthCheck)
+	default:
+		return httpCheck(e.url, s.healthCheck)
+	}
+}
+
+// checkAddress is the host and port that a check connects to: the check port if there is one, the endpoint port
+// otherwise, or the default port of the endpoint scheme
+func checkAddress(u url.URL, hc config.HealthCheckParsedConfig) string {
+	port := u.Port()
+	if hc.Port != 0 {
+		port = strconv.Itoa(int(hc.Port))
+	} else if port == "" && u.Scheme == "https" {
+		port = "443"
+	} else if port == "" {
+		port = "80"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// tcpCheck only opens a connection to the endpoint, completing a TLS handshake for https endpoints, and closes it
+func tcpCheck(u url.URL, hc config.HealthCheckParsedConfig) error {
+	ctx, cancel := context.WithTimeout(context.Background(), hc.Timeout)
+	defer cancel()
+	address := checkAddress(u, hc)
+	var conn net.Conn
+	var err error
+	if u.Scheme == "https" {
+		dialer := tls.Dialer{Config: &tls.Config{ServerName: u.Hostname()}}
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+	}
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// healthCheck is an endpoint check that returns an error on any reading error as well as 500 error codes
+func isUrlHealthy(u url.URL) error {
+	return httpCheck(u, config.DefaultHealthCheck())
+}
+
+// maxHealthCheckBody is how much of the response body is read to look for the expected content
+const maxHealthCheckBody = 64 * 1024
+
+// healthCheckClient never follows redirects, as the health of the endpoint itself is what is being checked
+var healthCheckClient = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+// httpCheck sends the check request described by hc to the endpoint, and returns an error explaining why the endpoint
+// is not healthy, if it isn't
+func httpCheck(u url.URL, hc config.HealthCheckParsedConfig) error {
+	if hc.Path != "" {
+		u.Path = strings.TrimSuffix(u.Path, "/") + hc.Path
+	}
+	if hc.Port != 0 {
+		u.Host = checkAddress(u, hc)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), hc.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, hc.Method, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range hc.Headers {
+		if http.CanonicalHeaderKey(k) == "Host" {
+			req.Host = v
+		} else {
+			req.Header.Set(k, v)
+		}
+	}
+	res, err := healthCheckClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if !slices.ContainsFunc(hc.ExpectedStatuses, func(sr config.StatusRange) bool {
+		return res.StatusCode >= sr.Min && res.StatusCode <= sr.Max
+	}) {
+		return fmt.Errorf("received unexpected %d status from %s", res.StatusCode, u.String())
+	}
+	if hc.Body == "" && hc.BodyRegex == nil {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxHealthCheckBody))
+	if err != nil {
+		return err
+	}
+	if hc.Body != "" && !bytes.Contains(body, []byte(hc.Body)) {
+		return fmt.Errorf("response body from %s does not contain %q", u.String(), hc.Body)
+	}
+	if hc.BodyRegex != nil && !hc.BodyRegex.Match(body) {
+		return fmt.Errorf("response body from %s does not match %s", u.String(), hc.BodyRegex.String())
+	}
+	return nil
+}
+
+func isEndpointListedHealthy(s string, u url.URL) bool {
+	// Skipping validation, this is supposed to be a safe environment
+	site := sites[s]
+	return slices.ContainsFunc(site.endpoints, func(e *endpoint) bool { return e.url == u })
+}
+
+// markUnhealthy evicts an endpoint from the list of healthy endpoints right away, without waiting for the next check
+func (s *site) markUnhealthy(e *endpoint) {
+	s.healthyEndpoints.mutex.Lock()
+	defer s.healthyEndpoints.mutex.Unlock()
+	currentHealthyEndpoints := new([]*endpoint)
+	for _, he := range *s.healthyEndpoints.endpoints {
+		if he != e {
+			*currentHealthyEndpoints = append(*currentHealthyEndpoints, he)
+		}
+	}
+	if len(*currentHealthyEndpoints) < len(*s.healthyEndpoints.endpoints) {
+		log.Wrapper(log.Info, fmt.Sprintf("Endpoint %s evicted from healthy endpoints list for site %s", e.url.String(), s.name))
+	}
+	s.healthyEndpoints.endpoints = currentHealthyEndpoints
+	s.healthyEndpoints.draining = slices.DeleteFunc(slices.Clone(s.healthyEndpoints.draining), func(de *endpoint) bool { return de == e })
+}
@@ -0,0 +1,28 @@
+package site
+
+import (
+	"testing"
+
+	"github.com/L1Cafe/lbx/config"
+)
+
+// readySite creates a site whose endpoints passed their first health check, and registers it until the end of the
+// test
+func readySite(t *testing.T, name string, conf config.SiteParsedConfig) *site {
+	s := newSite(name, conf)
+	for _, e := range s.endpoints {
+		e.health.recordCheck(nil, s.healthCheck)
+	}
+	s.updateHealthyEndpoints()
+	if sites == nil {
+		sites = map[string]*site{}
+	}
+	sites[name] = s
+	t.Cleanup(func() {
+		delete(sites, name)
+		if len(sites) == 0 {
+			sites = nil
+		}
+	})
+	return s
+}
@@ -0,0 +1,53 @@
+package site
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// ewmaDecay is the time constant of the latency average, observations older than this weigh roughly a third of
+// their original value
+const ewmaDecay = 10 * time.Second
+
+// failedRequestCost is the response time recorded for a request that got no response, so that an endpoint that fails
+// fast scores as a slow one instead of the cheapest one
+const failedRequestCost = 10 * time.Second
+
+// latency is a peak-sensitive exponentially weighted moving average of the response times of an endpoint. A slower
+// response than the current average replaces it at once, while faster responses bring it down gradually. The average
+// also decays towards zero while there are no observations, so an endpoint that stopped getting traffic for being
+// slow is eventually tried again.
+type latency struct {
+	mutex sync.Mutex
+	// cost is the average in nanoseconds
+	cost  float64
+	stamp time.Time
+}
+
+// observe adds the response time of a request to the average
+func (l *latency) observe(rtt time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	sample := float64(rtt)
+	if sample > l.cost {
+		l.cost = sample
+	} else {
+		w := math.Exp(-float64(now.Sub(l.stamp)) / float64(ewmaDecay))
+		l.cost = l.cost*w + sample*(1-w)
+	}
+	l.stamp = now
+}
+
+// observeFailure adds a request that got no response to the average
+func (l *latency) observeFailure() {
+	l.observe(failedRequestCost)
+}
+
+// value returns the average in nanoseconds
+func (l *latency) value() float64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.cost * math.Exp(-float64(time.Since(l.stamp))/float64(ewmaDecay))
+}
@@ -0,0 +1,70 @@
+package site
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/L1Cafe/lbx/config"
+)
+
+// valueMatches tells whether one of the values meets the rule
+func valueMatches(rule config.ValueMatchParsedConfig, values []string) bool {
+	for _, v := range values {
+		switch {
+		case rule.Regex != nil:
+			if rule.Regex.MatchString(v) {
+				return true
+			}
+		case rule.Prefix != "":
+			if strings.HasPrefix(v, rule.Prefix) {
+				return true
+			}
+		case rule.Exact != "":
+			if v == rule.Exact {
+				return true
+			}
+		default:
+			// The value only has to be present
+			return true
+		}
+	}
+	return false
+}
+
+// matches tells whether the request meets all the match rules of the site. A site without match rules accepts any
+// request.
+func (s *site) matches(r *http.Request) bool {
+	m := s.match
+	if m == nil {
+		return true
+	}
+	if len(m.Methods) > 0 && !slices.Contains(m.Methods, r.Method) {
+		return false
+	}
+	for _, rule := range m.Headers {
+		if !valueMatches(rule, r.Header.Values(rule.Name)) {
+			return false
+		}
+	}
+	if len(m.Query) > 0 {
+		query := r.URL.Query()
+		for _, rule := range m.Query {
+			if !valueMatches(rule, query[rule.Name]) {
+				return false
+			}
+		}
+	}
+	for _, rule := range m.Cookies {
+		var values []string
+		for _, c := range r.Cookies() {
+			if c.Name == rule.Name {
+				values = append(values, c.Value)
+			}
+		}
+		if !valueMatches(rule, values) {
+			return false
+		}
+	}
+	return true
+}
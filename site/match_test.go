@@ -0,0 +1,47 @@
+package site
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/L1Cafe/lbx/config"
+)
+
+func TestSiteMatches(t *testing.T) {
+	s := &site{match: &config.MatchParsedConfig{
+		Methods: []string{http.MethodGet, http.MethodPost},
+		Headers: []config.ValueMatchParsedConfig{{Name: "User-Agent", Prefix: "curl/"}},
+		Query:   []config.ValueMatchParsedConfig{{Name: "id", Regex: regexp.MustCompile(`^[0-9]+$`)}},
+		Cookies: []config.ValueMatchParsedConfig{{Name: "beta"}},
+	}}
+	request := func(method string, target string, agent string, cookie bool) *http.Request {
+		r := httptest.NewRequest(method, target, nil)
+		r.Header.Set("User-Agent", agent)
+		if cookie {
+			r.AddCookie(&http.Cookie{Name: "beta", Value: ""})
+		}
+		return r
+	}
+	for _, tc := range []struct {
+		name string
+		r    *http.Request
+		want bool
+	}{
+		{"all rules met", request(http.MethodGet, "/?id=42", "curl/8.0", true), true},
+		{"second query value", request(http.MethodPost, "/?id=x&id=7", "curl/8.0", true), true},
+		{"method", request(http.MethodDelete, "/?id=42", "curl/8.0", true), false},
+		{"header prefix", request(http.MethodGet, "/?id=42", "Mozilla/5.0", true), false},
+		{"query regex", request(http.MethodGet, "/?id=4x", "curl/8.0", true), false},
+		{"missing query parameter", request(http.MethodGet, "/", "curl/8.0", true), false},
+		{"missing cookie", request(http.MethodGet, "/?id=42", "curl/8.0", false), false},
+	} {
+		if got := s.matches(tc.r); got != tc.want {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.want, got)
+		}
+	}
+	if !(&site{}).matches(httptest.NewRequest(http.MethodPut, "/", nil)) {
+		t.Error("A site without match rules rejected a request")
+	}
+}
@@ -0,0 +1,265 @@
+package site
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/L1Cafe/lbx/config"
+	"github.com/L1Cafe/lbx/log"
+)
+
+// maxMirrorsInFlight caps the shadow requests of a site that are pending at once, so that a slow shadow group can't
+// pile up goroutines. Requests sampled while the cap is reached are not copied.
+const maxMirrorsInFlight = 64
+
+// MirrorStats counts what happened to the requests that a site copied to its shadow group
+type MirrorStats struct {
+	// Mirrored is the number of requests copied to the shadow group
+	Mirrored uint64 `json:"mirrored"`
+	// Skipped is the number of sampled requests that were not copied, because their body was too large, too many
+	// shadow requests were pending, or the shadow group had no healthy endpoint
+	Skipped uint64 `json:"skipped"`
+	// Failed is the number of shadow requests that got no complete response
+	Failed uint64 `json:"failed"`
+	// StatusMismatches, HeaderMismatches and BodyMismatches count the compared responses that differ
+	StatusMismatches uint64 `json:"status_mismatches"`
+	HeaderMismatches uint64 `json:"header_mismatches"`
+	BodyMismatches   uint64 `json:"body_mismatches"`
+}
+
+// mirror sends copies of the requests of a site to one of its endpoint groups
+type mirror struct {
+	conf  *config.MirrorParsedConfig
+	group *endpointGroup
+	slots chan struct{}
+
+	mirrored         atomic.Uint64
+	skipped          atomic.Uint64
+	failed           atomic.Uint64
+	statusMismatches atomic.Uint64
+	headerMismatches atomic.Uint64
+	bodyMismatches   atomic.Uint64
+}
+
+func newMirror(conf *config.MirrorParsedConfig, groups []*endpointGroup) *mirror {
+	m := &mirror{conf: conf, slots: make(chan struct{}, maxMirrorsInFlight)}
+	for _, g := range groups {
+		if g.name == conf.Group {
+			m.group = g
+		}
+	}
+	return m
+}
+
+// mirroredResponse is what is compared between the primary and the shadow responses
+type mirroredResponse struct {
+	status   int
+	header   http.Header
+	bodyHash []byte
+}
+
+// mirrorJob follows the primary response of a mirrored request, so that the shadow response can be compared with it
+type mirrorJob struct {
+	// primary receives the primary response once it has been sent to the client, or nil if it failed. It is nil when
+	// the responses are not compared.
+	primary  chan *mirroredResponse
+	status   int
+	header   http.Header
+	bodyHash hash.Hash
+}
+
+type teeReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// observe hashes the body of the primary response while it is copied to the client
+func (j *mirrorJob) observe(res *http.Response) {
+	if j == nil || j.primary == nil {
+		return
+	}
+	j.status = res.StatusCode
+	j.header = res.Header.Clone()
+	j.bodyHash = sha256.New()
+	res.Body = teeReadCloser{Reader: io.TeeReader(res.Body, j.bodyHash), Closer: res.Body}
+}
+
+// finish hands the primary response over to the comparison, err tells whether it was fully sent
+func (j *mirrorJob) finish(err error) {
+	if j == nil || j.primary == nil {
+		return
+	}
+	var res *mirroredResponse
+	if err == nil && j.bodyHash != nil {
+		res = &mirroredResponse{status: j.status, header: j.header, bodyHash: j.bodyHash.Sum(nil)}
+	}
+	select {
+	case j.primary <- res:
+	default:
+	}
+}
+
+// startMirror copies a sampled request to the shadow group. The request body is buffered so that it can be sent
+// twice. It returns nil when the request is not mirrored.
+func (s *site) startMirror(r *http.Request) *mirrorJob {
+	m := s.mirror
+	if m == nil || rand.Float64()*100 >= m.conf.Percent {
+		return nil
+	}
+	if r.ContentLength > m.conf.MaxBodySize {
+		m.skipped.Add(1)
+		return nil
+	}
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		m.skipped.Add(1)
+		return nil
+	}
+	release := func() { <-m.slots }
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody && r.ContentLength != 0 {
+		buf, err := io.ReadAll(io.LimitReader(r.Body, m.conf.MaxBodySize+1))
+		// The primary request still gets the whole body
+		r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(buf), r.Body))
+		if err != nil || int64(len(buf)) > m.conf.MaxBodySize {
+			release()
+			m.skipped.Add(1)
+			return nil
+		}
+		body = buf
+	}
+	e := s.shadowEndpoint(r)
+	if e == nil {
+		release()
+		m.skipped.Add(1)
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), m.conf.Timeout)
+	shadowR := r.Clone(ctx)
+	shadowR.Body = io.NopCloser(bytes.NewReader(body))
+	shadowR.ContentLength = int64(len(body))
+	outReq, err := newUpstreamRequest(shadowR, e.url, s.rewrite)
+	if err != nil {
+		cancel()
+		release()
+		m.failed.Add(1)
+		return nil
+	}
+	job := &mirrorJob{}
+	if m.conf.Compare {
+		job.primary = make(chan *mirroredResponse, 1)
+	}
+	m.mirrored.Add(1)
+	go func() {
+		defer release()
+		defer cancel()
+		s.runMirror(ctx, e, outReq, job)
+	}()
+	return job
+}
+
+// shadowEndpoint asks the balancer of the shadow group to choose one of its healthy endpoints
+func (s *site) shadowEndpoint(r *http.Request) *endpoint {
+	s.healthyEndpoints.mutex.RLock()
+	hEL := *s.healthyEndpoints.endpoints
+	s.healthyEndpoints.mutex.RUnlock()
+	var members []*endpoint
+	for _, e := range hEL {
+		if e.group == s.mirror.group {
+			members = append(members, e)
+		}
+	}
+	e, err := s.mirror.group.balancer.Next(members, r)
+	if err != nil {
+		return nil
+	}
+	return e
+}
+
+// runMirror sends the shadow request, throws its response away, and compares it with the primary response when
+// enabled
+func (s *site) runMirror(ctx context.Context, e *endpoint, outReq *http.Request, job *mirrorJob) {
+	e.inFlight.Add(1)
+	defer e.inFlight.Add(-1)
+	res, err := upstreamTransport.RoundTrip(outReq)
+	if err != nil {
+		s.recordPassiveResult(e, err, 0)
+		s.mirror.failed.Add(1)
+		log.Wrapper(log.Info, fmt.Sprintf("Mirrored request for site %s, path %s, to %s failed: %s", s.name, outReq.URL.Path, e.url.Host, err.Error()))
+		return
+	}
+	defer res.Body.Close()
+	s.recordPassiveResult(e, nil, res.StatusCode)
+	bodyHash := sha256.New()
+	if _, err := io.Copy(bodyHash, res.Body); err != nil {
+		s.mirror.failed.Add(1)
+		log.Wrapper(log.Info, fmt.Sprintf("Reading the mirrored response for site %s, path %s, from %s failed: %s", s.name, outReq.URL.Path, e.url.Host, err.Error()))
+		return
+	}
+	if job.primary == nil {
+		return
+	}
+	select {
+	case primary := <-job.primary:
+		if primary != nil {
+			s.compareMirror(outReq.URL.Path, primary, &mirroredResponse{status: res.StatusCode, header: res.Header, bodyHash: bodyHash.Sum(nil)})
+		}
+	case <-ctx.Done():
+	}
+}
+
+// compareMirror logs and counts the differences between the primary and the shadow responses
+func (s *site) compareMirror(path string, primary *mirroredResponse, shadow *mirroredResponse) {
+	var diffs []string
+	if primary.status != shadow.status {
+		s.mirror.statusMismatches.Add(1)
+		diffs = append(diffs, fmt.Sprintf("status %d != %d", primary.status, shadow.status))
+	}
+	headerMismatch := false
+	for _, h := range s.mirror.conf.CompareHeaders {
+		pv, sv := strings.Join(primary.header.Values(h), ", "), strings.Join(shadow.header.Values(h), ", ")
+		if pv != sv {
+			headerMismatch = true
+			diffs = append(diffs, fmt.Sprintf("header %s %q != %q", h, pv, sv))
+		}
+	}
+	if headerMismatch {
+		s.mirror.headerMismatches.Add(1)
+	}
+	if !bytes.Equal(primary.bodyHash, shadow.bodyHash) {
+		s.mirror.bodyMismatches.Add(1)
+		diffs = append(diffs, "body hash")
+	}
+	if len(diffs) > 0 {
+		log.Wrapper(log.Warn, fmt.Sprintf("Shadow response for site %s, path %s, differs from the primary response: %s", s.name, path, strings.Join(diffs, ", ")))
+	}
+}
+
+// SiteMirrorStats returns the mirroring counters of a site since it started
+func SiteMirrorStats(name string) (MirrorStats, error) {
+	s, err := lookupSite(name)
+	if err != nil {
+		return MirrorStats{}, err
+	}
+	if s.mirror == nil {
+		return MirrorStats{}, errors.New(fmt.Sprintf("site %s does not mirror requests", name))
+	}
+	return MirrorStats{
+		Mirrored:         s.mirror.mirrored.Load(),
+		Skipped:          s.mirror.skipped.Load(),
+		Failed:           s.mirror.failed.Load(),
+		StatusMismatches: s.mirror.statusMismatches.Load(),
+		HeaderMismatches: s.mirror.headerMismatches.Load(),
+		BodyMismatches:   s.mirror.bodyMismatches.Load(),
+	}, nil
+}
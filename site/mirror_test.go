@@ -0,0 +1,90 @@
+package site
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/L1Cafe/lbx/config"
+)
+
+func TestMirror(t *testing.T) {
+	shadowBodies := make(chan string, 10)
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = io.WriteString(w, "v1:"+string(body))
+	}))
+	defer primary.Close()
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		shadowBodies <- string(body)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = io.WriteString(w, "v2:"+string(body))
+	}))
+	defer shadow.Close()
+	pu, _ := url.Parse(primary.URL)
+	su, _ := url.Parse(shadow.URL)
+	s := readySite(t, "mirror_test", config.SiteParsedConfig{
+		RefreshPeriod: time.Second,
+		Path:          "/*",
+		HealthCheck:   config.DefaultHealthCheck(),
+		Groups: []config.EndpointGroupParsedConfig{
+			{Name: "live", Weight: 1, Endpoints: []config.EndpointParsedConfig{{URL: *pu, Weight: 1}}},
+			{Name: "shadow", Weight: 0, Endpoints: []config.EndpointParsedConfig{{URL: *su, Weight: 1}}},
+		},
+		Mirror: &config.MirrorParsedConfig{
+			Group:          "shadow",
+			Percent:        100,
+			Compare:        true,
+			CompareHeaders: []string{"Content-Type"},
+			MaxBodySize:    1 << 20,
+			Timeout:        5 * time.Second,
+		},
+	})
+
+	post := func(body string) string {
+		w := httptest.NewRecorder()
+		siteHandler(s)(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+		return w.Body.String()
+	}
+	if got := post("hello"); got != "v1:hello" {
+		t.Fatalf("Expected the client to get the primary response, got %q", got)
+	}
+	select {
+	case got := <-shadowBodies:
+		if got != "hello" {
+			t.Errorf("Expected the shadow group to get the request body, got %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The request was not mirrored")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats, err := SiteMirrorStats("mirror_test")
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		if stats.StatusMismatches == 1 && stats.HeaderMismatches == 1 && stats.BodyMismatches == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected one status, header and body mismatch, got %+v", stats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A body over the limit is not copied, and still reaches the primary endpoint in full
+	s.mirror.conf.MaxBodySize = 2
+	if got := post("hello"); got != "v1:hello" {
+		t.Errorf("Expected the primary endpoint to get the whole body, got %q", got)
+	}
+	if stats, _ := SiteMirrorStats("mirror_test"); stats.Mirrored != 1 || stats.Skipped != 1 {
+		t.Errorf("Expected 1 mirrored and 1 skipped request, got %+v", stats)
+	}
+}
@@ -0,0 +1,89 @@
+package site
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/L1Cafe/lbx/log"
+)
+
+// recordPassiveResult watches the outcome of a live request to an endpoint. A connection error, timeout or 5xx
+// response adds to the streak of failures of the endpoint, and any other response ends it. Once the streak reaches the
+// configured threshold, the endpoint is ejected.
+func (s *site) recordPassiveResult(e *endpoint, requestErr error, statusCode int) {
+	if s.outlierDetection == nil {
+		return
+	}
+	if requestErr != nil && errors.Is(requestErr, context.Canceled) {
+		// The client went away, which says nothing about the endpoint
+		return
+	}
+	e.health.mutex.Lock()
+	if requestErr == nil && statusCode < 500 {
+		e.health.passiveFailures = 0
+		e.health.mutex.Unlock()
+		return
+	}
+	e.health.passiveFailures++
+	reachedThreshold := e.health.passiveFailures >= s.outlierDetection.ConsecutiveFailures && e.health.state == stateHealthy
+	e.health.mutex.Unlock()
+	if !reachedThreshold {
+		return
+	}
+	reason := fmt.Sprintf("%d consecutive failed requests, the last one with status %d", s.outlierDetection.ConsecutiveFailures, statusCode)
+	if requestErr != nil {
+		reason = fmt.Sprintf("%d consecutive failed requests, the last one with error %s", s.outlierDetection.ConsecutiveFailures, requestErr.Error())
+	}
+	s.eject(e, reason)
+}
+
+// maxEjected is the number of endpoints of the site that can be ejected at the same time
+func (s *site) maxEjected() int {
+	allowed := len(s.endpoints) * int(s.outlierDetection.MaxEjectionPercent) / 100
+	if allowed == 0 && s.outlierDetection.MaxEjectionPercent > 0 {
+		allowed = 1
+	}
+	return allowed
+}
+
+// eject takes a healthy endpoint out of rotation for the ejection time, unless too many endpoints of the site are
+// ejected already. Ejections that happen close to each other make the ejection time grow exponentially.
+func (s *site) eject(e *endpoint, reason string) {
+	s.ejectionMutex.Lock()
+	defer s.ejectionMutex.Unlock()
+	ejected := 0
+	for _, other := range s.endpoints {
+		if other.health.current() == stateEjected {
+			ejected++
+		}
+	}
+	if ejected >= s.maxEjected() {
+		log.Wrapper(log.Warn, fmt.Sprintf("Endpoint %s of site %s was not ejected after %s, as %d endpoints are ejected already", e.url.String(), s.name, reason, ejected))
+		return
+	}
+	e.health.mutex.Lock()
+	if e.health.state != stateHealthy {
+		e.health.mutex.Unlock()
+		return
+	}
+	now := time.Now()
+	if now.Sub(e.health.lastEjection) > s.outlierDetection.MaxEjectionTime {
+		e.health.ejections = 0
+	}
+	ejectionTime := s.outlierDetection.EjectionTime << e.health.ejections
+	if ejectionTime > s.outlierDetection.MaxEjectionTime || ejectionTime <= 0 {
+		ejectionTime = s.outlierDetection.MaxEjectionTime
+	} else {
+		e.health.ejections++
+	}
+	e.health.state = stateEjected
+	e.health.ejectedUntil = now.Add(ejectionTime)
+	e.health.lastEjection = now
+	e.health.passiveFailures = 0
+	e.health.successes = 0
+	e.health.mutex.Unlock()
+	log.Wrapper(log.Warn, fmt.Sprintf("Endpoint %s of site %s went from %s to %s for %v: %s", e.url.String(), s.name, stateHealthy, stateEjected, ejectionTime, reason))
+	s.markUnhealthy(e)
+}
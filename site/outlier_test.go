@@ -0,0 +1,113 @@
+package site
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/L1Cafe/lbx/config"
+)
+
+func TestOutlierEjection(t *testing.T) {
+	var endpoints []config.EndpointParsedConfig
+	for _, status := range []int{http.StatusOK, http.StatusOK, http.StatusBadGateway, http.StatusInternalServerError} {
+		status := status
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		}))
+		defer upstream.Close()
+		u, _ := url.Parse(upstream.URL)
+		endpoints = append(endpoints, config.EndpointParsedConfig{URL: *u, Weight: 1})
+	}
+	s := newSite("outlier_test", config.SiteParsedConfig{
+		Endpoints:     endpoints,
+		RefreshPeriod: time.Second,
+		Path:          "/*",
+		Algorithm:     "round_robin",
+		HealthCheck:   config.DefaultHealthCheck(),
+		OutlierDetection: &config.OutlierDetectionParsedConfig{
+			ConsecutiveFailures: 3,
+			EjectionTime:        time.Minute,
+			MaxEjectionTime:     time.Hour,
+			MaxEjectionPercent:  25,
+		},
+	})
+	for _, e := range s.endpoints {
+		e.health.recordCheck(nil, s.healthCheck)
+	}
+	s.updateHealthyEndpoints()
+	for i := 0; i < 12; i++ {
+		siteHandler(s)(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+
+	ejected := 0
+	for _, e := range s.endpoints[2:] {
+		if e.health.current() == stateEjected {
+			ejected++
+		}
+	}
+	if ejected != 1 {
+		t.Errorf("Expected exactly one of the failing endpoints to be ejected because of max_ejection_percent, got %d", ejected)
+	}
+	if s.endpoints[0].health.current() != stateHealthy || s.endpoints[1].health.current() != stateHealthy {
+		t.Error("An endpoint that only returned successful responses was ejected")
+	}
+	if len(*s.healthyEndpoints.endpoints) != 3 {
+		t.Errorf("Expected the ejected endpoint to be evicted from the healthy endpoints, got %d healthy endpoints", len(*s.healthyEndpoints.endpoints))
+	}
+
+	// The active health checks don't bring the endpoint back before its ejection time ends
+	for _, e := range s.endpoints {
+		if e.health.current() != stateEjected {
+			continue
+		}
+		for i := 0; i < 3; i++ {
+			if _, to, _ := e.health.recordCheck(nil, s.healthCheck); to != stateEjected {
+				t.Errorf("Expected the endpoint to stay ejected, got %s", to)
+			}
+		}
+		e.health.ejectedUntil = time.Now()
+		e.health.recordCheck(nil, s.healthCheck)
+		if _, to, _ := e.health.recordCheck(nil, s.healthCheck); to != stateHealthy {
+			t.Errorf("Expected the endpoint to recover once its ejection time ended, got %s", to)
+		}
+	}
+}
+
+func TestOutlierEjectionOnTimeout(t *testing.T) {
+	hang := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hang
+	}))
+	defer upstream.Close()
+	defer close(hang)
+	u, _ := url.Parse(upstream.URL)
+	s := newSite("timeout_test", config.SiteParsedConfig{
+		Endpoints:       []config.EndpointParsedConfig{{URL: *u, Weight: 1}},
+		RefreshPeriod:   time.Second,
+		Path:            "/*",
+		HealthCheck:     config.DefaultHealthCheck(),
+		ResponseTimeout: 100 * time.Millisecond,
+		OutlierDetection: &config.OutlierDetectionParsedConfig{
+			ConsecutiveFailures: 2,
+			EjectionTime:        time.Minute,
+			MaxEjectionTime:     time.Hour,
+			MaxEjectionPercent:  100,
+		},
+	})
+	s.endpoints[0].health.recordCheck(nil, s.healthCheck)
+	s.updateHealthyEndpoints()
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		siteHandler(s)(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if w.Code != http.StatusGatewayTimeout {
+			t.Errorf("Expected a request to a hanging endpoint to fail with status 504, got %d", w.Code)
+		}
+	}
+	if state := s.endpoints[0].health.current(); state != stateEjected {
+		t.Errorf("Expected the endpoint that never answers to be ejected, got %s", state)
+	}
+
+}
@@ -0,0 +1,268 @@
+package site
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// hopHeaders are the hop-by-hop headers defined in RFC 9110, section 7.6.1. They are only meaningful for a single
+// connection and must not be forwarded by proxies, except for "TE: trailers" and protocol upgrades, which are set
+// again on the upstream request.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// upstreamTransport is shared by all sites so that connections to the endpoints are reused. Redirects are never
+// followed, they are passed back to the client as they are.
+var upstreamTransport = &http.Transport{
+	Proxy: http.ProxyFromEnvironment,
+	DialContext: (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext,
+	ForceAttemptHTTP2:     true,
+	MaxIdleConns:          100,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ExpectContinueTimeout: 1 * time.Second,
+}
+
+// errResponseTimeout fails the requests whose endpoint didn't send the headers of the response within the response
+// timeout of the site
+var errResponseTimeout = errors.New("the endpoint did not send its response headers in time")
+
+// responseDeadline cancels an upstream request when the headers of its response don't arrive in time
+type responseDeadline struct {
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	timer  *time.Timer
+}
+
+// withResponseDeadline returns the request bound to a deadline of timeout for its response headers. There is no
+// deadline when timeout is 0.
+func withResponseDeadline(outReq *http.Request, timeout time.Duration) (*http.Request, *responseDeadline) {
+	if timeout <= 0 {
+		return outReq, nil
+	}
+	ctx, cancel := context.WithCancelCause(outReq.Context())
+	d := &responseDeadline{ctx: ctx, cancel: cancel}
+	d.timer = time.AfterFunc(timeout, func() { cancel(errResponseTimeout) })
+	return outReq.WithContext(ctx), d
+}
+
+// headersReceived stops the deadline once the round trip is over, and turns the error of a request that ran out of
+// time into errResponseTimeout
+func (d *responseDeadline) headersReceived(res *http.Response, err error) error {
+	if d == nil {
+		return err
+	}
+	if d.timer.Stop() {
+		return err
+	}
+	// The deadline fired, the response body can't be read anymore even if the headers made it
+	if res != nil {
+		res.Body.Close()
+	}
+	if err == nil || errors.Is(context.Cause(d.ctx), errResponseTimeout) {
+		return errResponseTimeout
+	}
+	return err
+}
+
+// release frees the context of the request once its response has been copied
+func (d *responseDeadline) release() {
+	if d != nil {
+		d.cancel(nil)
+	}
+}
+
+// removeHopHeaders deletes the hop-by-hop headers, including the ones listed in the Connection header
+func removeHopHeaders(h http.Header) {
+	for _, f := range h.Values("Connection") {
+		for _, sf := range strings.Split(f, ",") {
+			if sf = strings.TrimSpace(sf); sf != "" {
+				h.Del(sf)
+			}
+		}
+	}
+	for _, hh := range hopHeaders {
+		h.Del(hh)
+	}
+}
+
+// headerContainsToken tells whether one of the comma separated values of a header is token, ignoring its parameters
+func headerContainsToken(values []string, token string) bool {
+	for _, v := range values {
+		for _, t := range strings.Split(v, ",") {
+			t, _, _ = strings.Cut(t, ";")
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upgradeType is the protocol that a request asks to switch to, or that a response switches to, if any
+func upgradeType(h http.Header) string {
+	if !headerContainsToken(h["Connection"], "upgrade") {
+		return ""
+	}
+	return h.Get("Upgrade")
+}
+
+func copyHeader(dst, src http.Header) {
+	for key, values := range src {
+		for _, value := range values {
+			dst.Add(key, value)
+		}
+	}
+}
+
+// newUpstreamRequest builds the request that is sent to the endpoint. The path is rewritten and joined with the path
+// of the endpoint URL, the method, headers, query and body of the client request are kept, and the X-Forwarded-*
+// headers are added.
+func newUpstreamRequest(r *http.Request, endpoint url.URL, rewrite *pathRewrite) (*http.Request, error) {
+	target := endpoint
+	target.Path, target.RawPath = joinURLPath(&endpoint, rewrite.apply(r.URL))
+	target.RawQuery = r.URL.RawQuery
+	body := r.Body
+	if r.ContentLength == 0 {
+		body = nil
+	}
+	outReq, err := http.NewRequestWithContext(r.Context(), r.Method, target.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	outReq.ContentLength = r.ContentLength
+	outReq.Header = r.Header.Clone()
+	if outReq.Header == nil {
+		outReq.Header = http.Header{}
+	}
+	removeHopHeaders(outReq.Header)
+	// gRPC clients need the endpoint to know that they accept trailers
+	if headerContainsToken(r.Header["Te"], "trailers") {
+		outReq.Header.Set("Te", "trailers")
+	}
+	if upgrade := upgradeType(r.Header); upgrade != "" {
+		outReq.Header.Set("Connection", "Upgrade")
+		outReq.Header.Set("Upgrade", upgrade)
+	}
+	if clientIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := outReq.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			clientIP = strings.Join(prior, ", ") + ", " + clientIP
+		}
+		outReq.Header.Set("X-Forwarded-For", clientIP)
+	}
+	outReq.Header.Set("X-Forwarded-Host", r.Host)
+	if r.TLS != nil {
+		outReq.Header.Set("X-Forwarded-Proto", "https")
+	} else {
+		outReq.Header.Set("X-Forwarded-Proto", "http")
+	}
+	return outReq, nil
+}
+
+// copyResponse streams the upstream response to the client. Headers are copied before WriteHeader is called, and
+// streaming responses are flushed as soon as data arrives.
+func copyResponse(w http.ResponseWriter, res *http.Response) error {
+	removeHopHeaders(res.Header)
+	copyHeader(w.Header(), res.Header)
+	announcedTrailers := len(res.Trailer)
+	if announcedTrailers > 0 {
+		trailerKeys := make([]string, 0, announcedTrailers)
+		for k := range res.Trailer {
+			trailerKeys = append(trailerKeys, k)
+		}
+		w.Header().Add("Trailer", strings.Join(trailerKeys, ", "))
+	}
+	w.WriteHeader(res.StatusCode)
+	flusher, canFlush := w.(http.Flusher)
+	stream := canFlush && (res.ContentLength == -1 || strings.HasPrefix(res.Header.Get("Content-Type"), "text/event-stream"))
+	buf := make([]byte, 32*1024)
+	for {
+		n, rErr := res.Body.Read(buf)
+		if n > 0 {
+			if _, wErr := w.Write(buf[:n]); wErr != nil {
+				return wErr
+			}
+			if stream {
+				flusher.Flush()
+			}
+		}
+		if rErr == io.EOF {
+			break
+		}
+		if rErr != nil {
+			return rErr
+		}
+	}
+	for k, values := range res.Trailer {
+		if announcedTrailers == 0 {
+			k = http.TrailerPrefix + k
+		}
+		for _, v := range values {
+			w.Header().Add(k, v)
+		}
+	}
+	return nil
+}
+
+// switchProtocols hands the client connection over to the endpoint once it accepted to switch protocols, for
+// WebSocket or h2c for instance. The bytes are copied both ways until either side closes its connection. The client
+// gets a 502 when the connection can't be handed over.
+func switchProtocols(w http.ResponseWriter, r *http.Request, res *http.Response) error {
+	requested, switched := upgradeType(r.Header), upgradeType(res.Header)
+	if !strings.EqualFold(requested, switched) {
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return errors.New(fmt.Sprintf("endpoint switched to protocol %q when %q was requested", switched, requested))
+	}
+	backConn, ok := res.Body.(io.ReadWriteCloser)
+	if !ok {
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return errors.New("the connection to the endpoint can't be written to after switching protocols")
+	}
+	defer backConn.Close()
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return fmt.Errorf("taking over the client connection: %w", err)
+	}
+	defer conn.Close()
+	removeHopHeaders(res.Header)
+	res.Header.Set("Connection", "Upgrade")
+	res.Header.Set("Upgrade", switched)
+	res.Body = nil
+	if err := res.Write(brw); err != nil {
+		return err
+	}
+	if err := brw.Flush(); err != nil {
+		return err
+	}
+	done := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(backConn, brw)
+		done <- err
+	}()
+	go func() {
+		_, err := io.Copy(conn, backConn)
+		done <- err
+	}()
+	// Either side closing its connection ends the exchange, the deferred closes stop the other copy
+	return <-done
+}
@@ -0,0 +1,116 @@
+package site
+
+import (
+	"bufio"
+	"github.com/L1Cafe/lbx/config"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSiteHandlerForwardsRequest(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get("Connection") != "" || r.Header.Get("X-Hop") != "" {
+			t.Errorf("Hop-by-hop headers were forwarded: %v", r.Header)
+		}
+		w.Header().Set("X-Method", r.Method)
+		w.Header().Set("X-Query", r.URL.RawQuery)
+		w.Header().Set("X-Custom", r.Header.Get("X-Custom"))
+		w.Header().Set("X-Forwarded-For", r.Header.Get("X-Forwarded-For"))
+		w.Header().Set("X-Te", r.Header.Get("Te"))
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write(body)
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+	s := newSite("proxy_test", config.SiteParsedConfig{Endpoints: []config.EndpointParsedConfig{{URL: *u, Weight: 1}}, RefreshPeriod: time.Second, Path: "/*"})
+	*s.healthyEndpoints.endpoints = s.endpoints
+
+	for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete} {
+		req := httptest.NewRequest(method, "/some/path?a=1&b=two", strings.NewReader("payload"))
+		req.Header.Set("X-Custom", "custom value")
+		req.Header.Set("Connection", "X-Hop")
+		req.Header.Set("X-Hop", "must not be forwarded")
+		req.Header.Set("Te", "trailers")
+		rec := httptest.NewRecorder()
+		siteHandler(s)(rec, req)
+		res := rec.Result()
+		if res.StatusCode != http.StatusCreated {
+			t.Errorf("%s: expected status %d, got %d", method, http.StatusCreated, res.StatusCode)
+		}
+		if res.Header.Get("X-Method") != method {
+			t.Errorf("Expected method %s to reach the endpoint, got %s", method, res.Header.Get("X-Method"))
+		}
+		if res.Header.Get("X-Query") != "a=1&b=two" {
+			t.Errorf("Query string was not forwarded, got %q", res.Header.Get("X-Query"))
+		}
+		if res.Header.Get("X-Custom") != "custom value" {
+			t.Errorf("Request header was not forwarded, got %q", res.Header.Get("X-Custom"))
+		}
+		if res.Header.Get("X-Forwarded-For") == "" {
+			t.Error("X-Forwarded-For was not set")
+		}
+		if res.Header.Get("X-Te") != "trailers" {
+			t.Errorf("TE: trailers was not forwarded, got %q", res.Header.Get("X-Te"))
+		}
+		body, _ := io.ReadAll(res.Body)
+		if string(body) != "payload" {
+			t.Errorf("Request body was not forwarded, got %q", string(body))
+		}
+	}
+}
+
+func TestSiteHandlerSwitchesProtocols(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if upgradeType(r.Header) != "echo" {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Errorf("%s", err)
+			return
+		}
+		defer conn.Close()
+		_, _ = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		_ = brw.Flush()
+		line, _ := brw.ReadString('\n')
+		_, _ = conn.Write([]byte("echo " + line))
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+	s := newSite("upgrade_test", config.SiteParsedConfig{Endpoints: []config.EndpointParsedConfig{{URL: *u, Weight: 1}}, RefreshPeriod: time.Second, Path: "/*"})
+	*s.healthyEndpoints.endpoints = s.endpoints
+	proxy := httptest.NewServer(siteHandler(s))
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n"); err != nil {
+		t.Fatalf("%s", err)
+	}
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols || upgradeType(res.Header) != "echo" {
+		t.Fatalf("Expected the client to switch to the echo protocol, got status %d and headers %v", res.StatusCode, res.Header)
+	}
+	if _, err := io.WriteString(conn, "ping\n"); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if line, _ := br.ReadString('\n'); line != "echo ping\n" {
+		t.Errorf("Expected the endpoint to answer over the switched connection, got %q", line)
+	}
+}
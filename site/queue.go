@@ -0,0 +1,106 @@
+package site
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+
+	"github.com/L1Cafe/lbx/log"
+)
+
+// healthCheckQueueSize is the number of on-demand checks that can wait to be run
+const healthCheckQueueSize = 64
+
+// healthCheckJob is an on-demand check of a whole site, or of a single endpoint when endpoint is not nil
+type healthCheckJob struct {
+	site     *site
+	endpoint *endpoint
+}
+
+// healthCheckQueue holds the on-demand checks, which are run one at a time by healthCheckWorker
+var healthCheckQueue chan healthCheckJob
+
+// pendingChecks holds the jobs that are in healthCheckQueue, so that the same check is never queued twice
+var pendingChecks map[healthCheckJob]bool
+
+var pendingChecksMutex sync.Mutex
+
+var errQueueFull = errors.New("the health check queue is full")
+
+// enqueue adds a job to the queue, unless the same job is already waiting
+func (j healthCheckJob) enqueue() error {
+	pendingChecksMutex.Lock()
+	defer pendingChecksMutex.Unlock()
+	if pendingChecks[j] {
+		return nil
+	}
+	select {
+	case healthCheckQueue <- j:
+		pendingChecks[j] = true
+		return nil
+	default:
+		return errQueueFull
+	}
+}
+
+// healthCheckWorker runs the on-demand checks, and swaps the healthy endpoints of the site right after each of them.
+// Intended to be run as goroutine, after adding it to runningGoroutines.
+func healthCheckWorker(queue chan healthCheckJob, shutdown chan bool) {
+	defer runningGoroutines.Done()
+	for {
+		select {
+		case <-shutdown:
+			return
+		case j := <-queue:
+			pendingChecksMutex.Lock()
+			delete(pendingChecks, j)
+			pendingChecksMutex.Unlock()
+			if j.endpoint != nil {
+				j.site.checkEndpoint(j.endpoint)
+			} else {
+				j.site.checkEndpoints(j.site.endpoints)
+			}
+			j.site.updateHealthyEndpoints()
+		}
+	}
+}
+
+// queueSiteHealthCheck queues a check of every endpoint of a site
+func queueSiteHealthCheck(s string) error {
+	site, err := lookupSite(s)
+	if err != nil {
+		return err
+	}
+	log.Wrapper(log.Info, fmt.Sprintf("Queueing health check for site %s", s))
+	return healthCheckJob{site: site}.enqueue()
+}
+
+// queueEndpointHealthCheck queues a check of a single endpoint of a site
+func queueEndpointHealthCheck(s string, u url.URL) error {
+	site, err := lookupSite(s)
+	if err != nil {
+		return err
+	}
+	for _, e := range site.endpoints {
+		if e.url == u {
+			log.Wrapper(log.Info, fmt.Sprintf("Queueing health check for endpoint %s of site %s", u.String(), s))
+			return healthCheckJob{site: site, endpoint: e}.enqueue()
+		}
+	}
+	return errors.New(fmt.Sprintf("site %s has no endpoint %s", s, u.String()))
+}
+
+// CheckSite checks every endpoint of a site right away, without waiting for its next periodic check
+func CheckSite(name string) error {
+	return queueSiteHealthCheck(name)
+}
+
+// CheckEndpoint checks an endpoint of a site right away, without waiting for its next periodic check
+func CheckEndpoint(name string, endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return err
+	}
+	return queueEndpointHealthCheck(name, *u)
+}
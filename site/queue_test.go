@@ -0,0 +1,109 @@
+package site
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/L1Cafe/lbx/config"
+)
+
+func TestHealthCheckQueue(t *testing.T) {
+	var healthy atomic.Bool
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+	hc := config.DefaultHealthCheck()
+	hc.HealthyThreshold = 1
+	s := newSite("queue_test", config.SiteParsedConfig{
+		Endpoints:     []config.EndpointParsedConfig{{URL: *u, Weight: 1}},
+		RefreshPeriod: time.Hour,
+		Path:          "/*",
+		HealthCheck:   hc,
+	})
+	sites = map[string]*site{"queue_test": s}
+	healthCheckQueue = make(chan healthCheckJob, 2)
+	pendingChecks = map[healthCheckJob]bool{}
+	gracefulShutdownChannel = make(chan bool)
+
+	// Checks are de-duplicated while they wait, and the queue is bounded
+	for i := 0; i < 3; i++ {
+		if err := queueSiteHealthCheck("queue_test"); err != nil {
+			t.Fatalf("%s", err)
+		}
+	}
+	if err := queueEndpointHealthCheck("queue_test", *u); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if len(healthCheckQueue) != 2 {
+		t.Errorf("Expected 2 distinct checks in the queue, got %d", len(healthCheckQueue))
+	}
+	if err := (healthCheckJob{site: s, endpoint: &endpoint{}}).enqueue(); err == nil {
+		t.Error("Expected an error when the queue is full")
+	}
+	if err := queueSiteHealthCheck("does_not_exist"); err == nil {
+		t.Error("Expected an error when queueing a check for an unknown site")
+	}
+
+	healthy.Store(true)
+	runningGoroutines.Add(1)
+	go healthCheckWorker(healthCheckQueue, gracefulShutdownChannel)
+	defer func() {
+		close(gracefulShutdownChannel)
+		runningGoroutines.Wait()
+		sites, healthCheckQueue, pendingChecks, gracefulShutdownChannel = nil, nil, nil, nil
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.healthyEndpoints.mutex.RLock()
+		n := len(*s.healthyEndpoints.endpoints)
+		s.healthyEndpoints.mutex.RUnlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("The queued checks did not update the healthy endpoints")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFailedRequestQueuesCheck(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	u, _ := url.Parse(upstream.URL)
+	s := newSite("failed_test", config.SiteParsedConfig{
+		Endpoints:     []config.EndpointParsedConfig{{URL: *u, Weight: 1}},
+		RefreshPeriod: time.Hour,
+		Path:          "/*",
+		HealthCheck:   config.DefaultHealthCheck(),
+	})
+	s.endpoints[0].health.recordCheck(nil, s.healthCheck)
+	s.updateHealthyEndpoints()
+	healthCheckQueue = make(chan healthCheckJob, 2)
+	pendingChecks = map[healthCheckJob]bool{}
+	defer func() { healthCheckQueue, pendingChecks = nil, nil }()
+
+	// A client that goes away doesn't queue a check
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	siteHandler(s)(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+	if len(healthCheckQueue) != 0 {
+		t.Errorf("Expected no check to be queued when the client goes away, got %d", len(healthCheckQueue))
+	}
+	// An endpoint that can't be reached does
+	upstream.Close()
+	siteHandler(s)(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if len(healthCheckQueue) != 1 {
+		t.Errorf("Expected a check to be queued when the endpoint can't be reached, got %d", len(healthCheckQueue))
+	}
+}
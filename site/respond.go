@@ -0,0 +1,84 @@
+package site
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/L1Cafe/lbx/log"
+)
+
+// defaultMaintenancePage is served by the sites in maintenance mode that have no maintenance page of their own
+const defaultMaintenancePage = `<!DOCTYPE html>
+<html>
+<head><title>Down for maintenance</title></head>
+<body><h1>Down for maintenance</h1><p>This site is down for planned maintenance, please come back later.</p></body>
+</html>
+`
+
+// serveMaintenance answers with the maintenance page of the site and a 503 status
+func (s *site) serveMaintenance(w http.ResponseWriter) {
+	body, contentType := defaultMaintenancePage, "text/html; charset=utf-8"
+	if m := s.maintenance; m != nil {
+		if m.Body != "" {
+			body = m.Body
+		}
+		contentType = m.ContentType
+		if m.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(m.RetryAfter.Seconds())))
+		}
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	_, _ = io.WriteString(w, body)
+}
+
+// serveStatic answers with the fixed response of a static site
+func (s *site) serveStatic(w http.ResponseWriter) {
+	for k, v := range s.static.Headers {
+		w.Header().Set(k, v)
+	}
+	w.WriteHeader(s.static.Status)
+	_, _ = io.WriteString(w, s.static.Body)
+}
+
+// redirectTarget fills the placeholders of a redirect target with the values of the request
+func redirectTarget(target string, r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return strings.NewReplacer(
+		"{scheme}", scheme,
+		"{host}", r.Host,
+		"{path}", r.URL.EscapedPath(),
+		"{query}", r.URL.RawQuery,
+		"{uri}", r.URL.RequestURI(),
+	).Replace(target)
+}
+
+// serveRedirect sends the client to the target of a redirect site
+func (s *site) serveRedirect(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Location", redirectTarget(s.redirect.Target, r))
+	w.WriteHeader(s.redirect.Status)
+}
+
+// SetMaintenance puts a site in maintenance mode, or takes it out of it. In maintenance mode, the site answers every
+// request with its maintenance page and a 503 status instead of its usual response.
+func SetMaintenance(name string, enabled bool) error {
+	s, err := lookupSite(name)
+	if err != nil {
+		return err
+	}
+	if s.inMaintenance.Swap(enabled) != enabled {
+		state := "out of"
+		if enabled {
+			state = "in"
+		}
+		log.Wrapper(log.Info, fmt.Sprintf("Site %s is now %s maintenance mode", name, state))
+	}
+	return nil
+}
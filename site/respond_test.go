@@ -0,0 +1,60 @@
+package site
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/L1Cafe/lbx/config"
+)
+
+func TestSelfAnsweringSites(t *testing.T) {
+	static := newSite("static_test", config.SiteParsedConfig{
+		Path:   "/*",
+		Type:   "static",
+		Static: &config.StaticParsedConfig{Status: http.StatusGone, Body: "gone", Headers: map[string]string{"Content-Type": "text/plain"}},
+	})
+	redirect := newSite("redirect_test", config.SiteParsedConfig{
+		Path:     "/*",
+		Type:     "redirect",
+		Redirect: &config.RedirectParsedConfig{Status: http.StatusPermanentRedirect, Target: "https://new.example.com{uri}#from-{host}"},
+	})
+	sites = map[string]*site{"static_test": static, "redirect_test": redirect}
+	defer func() { sites = nil }()
+
+	w := httptest.NewRecorder()
+	siteHandler(static)(w, httptest.NewRequest(http.MethodGet, "/old", nil))
+	if w.Code != http.StatusGone || w.Body.String() != "gone" || w.Header().Get("Content-Type") != "text/plain" {
+		t.Errorf("Unexpected static response: %d %q %v", w.Code, w.Body.String(), w.Header())
+	}
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/a%20b?x=1", nil)
+	r.Host = "old.example.com"
+	siteHandler(redirect)(w, r)
+	if want := "https://new.example.com/a%20b?x=1#from-old.example.com"; w.Code != http.StatusPermanentRedirect || w.Header().Get("Location") != want {
+		t.Errorf("Expected a 308 redirect to %s, got %d to %s", want, w.Code, w.Header().Get("Location"))
+	}
+
+	if err := SetMaintenance("redirect_test", true); err != nil {
+		t.Fatalf("%s", err)
+	}
+	redirect.maintenance = &config.MaintenanceParsedConfig{Body: "back soon", ContentType: "text/plain", RetryAfter: 2 * time.Minute}
+	w = httptest.NewRecorder()
+	siteHandler(redirect)(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Body.String() != "back soon" || w.Header().Get("Retry-After") != "120" {
+		t.Errorf("Unexpected maintenance response: %d %q %v", w.Code, w.Body.String(), w.Header())
+	}
+	if err := SetMaintenance("redirect_test", false); err != nil {
+		t.Fatalf("%s", err)
+	}
+	w = httptest.NewRecorder()
+	siteHandler(redirect)(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusPermanentRedirect {
+		t.Errorf("Expected the site to redirect again once out of maintenance mode, got %d", w.Code)
+	}
+	if err := SetMaintenance("does_not_exist", true); err == nil {
+		t.Error("Expected an error for an unknown site")
+	}
+}
@@ -0,0 +1,100 @@
+package site
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/L1Cafe/lbx/config"
+)
+
+// pathRewrite turns the path of a client request into the path that is sent to the endpoints, before it is joined
+// with the path of the endpoint URL
+type pathRewrite struct {
+	stripPrefix string
+	rules       []config.RewriteParsedConfig
+	addPrefix   string
+}
+
+// newPathRewrite returns nil when the site forwards paths as they are
+func newPathRewrite(conf config.SiteParsedConfig) *pathRewrite {
+	if conf.StripPrefix == "" && conf.AddPrefix == "" && len(conf.Rewrite) == 0 {
+		return nil
+	}
+	return &pathRewrite{stripPrefix: conf.StripPrefix, rules: conf.Rewrite, addPrefix: conf.AddPrefix}
+}
+
+// escapePath is the escaped form of a plain path
+func escapePath(path string) string {
+	return (&url.URL{Path: path}).EscapedPath()
+}
+
+// cutPathPrefix removes prefix from path when it is made of whole path segments, so that /api doesn't strip /apis
+func cutPathPrefix(path string, prefix string) (string, bool) {
+	rest, found := strings.CutPrefix(path, prefix)
+	if !found || (rest != "" && !strings.HasPrefix(rest, "/")) {
+		return path, false
+	}
+	if rest == "" {
+		rest = "/"
+	}
+	return rest, true
+}
+
+// apply returns the rewritten path of u. The escaped form of the path is kept, unless a rewrite rule changes the path.
+func (pr *pathRewrite) apply(u *url.URL) *url.URL {
+	out := &url.URL{Path: u.Path, RawPath: u.RawPath}
+	if pr == nil {
+		return out
+	}
+	if pr.stripPrefix != "" {
+		if path, ok := cutPathPrefix(out.Path, pr.stripPrefix); ok {
+			out.Path = path
+			if out.RawPath != "" {
+				out.RawPath, ok = cutPathPrefix(out.RawPath, escapePath(pr.stripPrefix))
+				if !ok {
+					out.RawPath = ""
+				}
+			}
+		}
+	}
+	for _, rule := range pr.rules {
+		if path := rule.Regex.ReplaceAllString(out.Path, rule.Replacement); path != out.Path {
+			out.Path = path
+			out.RawPath = ""
+		}
+	}
+	if pr.addPrefix != "" {
+		out.Path = singleJoiningSlash(pr.addPrefix, out.Path)
+		if out.RawPath != "" {
+			out.RawPath = singleJoiningSlash(escapePath(pr.addPrefix), out.RawPath)
+		}
+	}
+	return out
+}
+
+// singleJoiningSlash joins two paths with exactly one slash between them
+func singleJoiningSlash(a, b string) string {
+	aSlash := strings.HasSuffix(a, "/")
+	bSlash := strings.HasPrefix(b, "/")
+	switch {
+	case aSlash && bSlash:
+		return a + b[1:]
+	case !aSlash && !bSlash:
+		return a + "/" + b
+	}
+	return a + b
+}
+
+// joinURLPath appends the path of b to the path of the endpoint URL a. Both the plain and the escaped forms are
+// returned, the escaped form is empty when it is the default encoding of the plain one.
+func joinURLPath(a *url.URL, b *url.URL) (path string, rawPath string) {
+	if a.RawPath == "" && b.RawPath == "" {
+		return singleJoiningSlash(a.Path, b.Path), ""
+	}
+	path = singleJoiningSlash(a.Path, b.Path)
+	rawPath = singleJoiningSlash(a.EscapedPath(), b.EscapedPath())
+	if rawPath == escapePath(path) {
+		rawPath = ""
+	}
+	return path, rawPath
+}
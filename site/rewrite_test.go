@@ -0,0 +1,41 @@
+package site
+
+import (
+	"net/url"
+	"regexp"
+	"testing"
+
+	"github.com/L1Cafe/lbx/config"
+)
+
+func TestUpstreamPath(t *testing.T) {
+	for _, tc := range []struct {
+		endpoint string
+		conf     config.SiteParsedConfig
+		request  string
+		want     string
+	}{
+		{"http://backend", config.SiteParsedConfig{}, "/folder/page", "/folder/page"},
+		{"http://backend/", config.SiteParsedConfig{}, "/folder/page", "/folder/page"},
+		{"http://backend/base", config.SiteParsedConfig{}, "/folder/page", "/base/folder/page"},
+		{"http://backend/base/", config.SiteParsedConfig{}, "/", "/base/"},
+		{"http://backend", config.SiteParsedConfig{}, "/a%2Fb", "/a%2Fb"},
+		{"http://backend", config.SiteParsedConfig{StripPrefix: "/api"}, "/api/users", "/users"},
+		{"http://backend", config.SiteParsedConfig{StripPrefix: "/api"}, "/api", "/"},
+		{"http://backend", config.SiteParsedConfig{StripPrefix: "/api"}, "/apis/users", "/apis/users"},
+		{"http://backend", config.SiteParsedConfig{StripPrefix: "/api"}, "/api/a%2Fb", "/a%2Fb"},
+		{"http://backend/base", config.SiteParsedConfig{StripPrefix: "/api", AddPrefix: "/v2"}, "/api/users", "/base/v2/users"},
+		{"http://backend", config.SiteParsedConfig{
+			StripPrefix: "/api",
+			Rewrite:     []config.RewriteParsedConfig{{Regex: regexp.MustCompile(`^/users/([0-9]+)$`), Replacement: "/accounts/$1/profile"}},
+		}, "/api/users/42", "/accounts/42/profile"},
+	} {
+		endpoint, _ := url.Parse(tc.endpoint)
+		request, _ := url.Parse(tc.request)
+		target := *endpoint
+		target.Path, target.RawPath = joinURLPath(endpoint, newPathRewrite(tc.conf).apply(request))
+		if got := target.EscapedPath(); got != tc.want {
+			t.Errorf("Expected %s via %s to be forwarded as %s, got %s", tc.request, tc.endpoint, tc.want, got)
+		}
+	}
+}
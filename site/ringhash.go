@@ -0,0 +1,130 @@
+package site
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/L1Cafe/lbx/config"
+)
+
+// ringPointsPerWeight is the number of points each unit of configured weight puts on the ring. More points give a more
+// even spread of keys at the cost of a larger ring.
+const ringPointsPerWeight = 160
+
+type ringPoint struct {
+	hash     uint64
+	endpoint *endpoint
+}
+
+// ringHashBalancer is a consistent hash over a ring of points. Every endpoint owns the keys that hash between its
+// points and the points before them, so adding or removing an endpoint only moves the keys of that endpoint. The ring
+// is rebuilt whenever the list of healthy endpoints it was built for, or their weights, change.
+type ringHashBalancer struct {
+	hashKey config.HashKeyParsedConfig
+	mutex   sync.RWMutex
+	members []*endpoint
+	weights []uint
+	ring    []ringPoint
+}
+
+func newRingHashBalancer(hashKey config.HashKeyParsedConfig) *ringHashBalancer {
+	return &ringHashBalancer{hashKey: hashKey}
+}
+
+// hash64 is FNV-1a followed by the splitmix64 finaliser, as FNV alone spreads similar strings poorly
+func hash64(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func buildRing(endpoints []*endpoint) []ringPoint {
+	var ring []ringPoint
+	for _, e := range endpoints {
+		name := e.url.String()
+		points := ringPointsPerWeight * int(e.effectiveWeight()) / 100
+		for i := 0; i < points; i++ {
+			ring = append(ring, ringPoint{hash: hash64(name + "#" + strconv.Itoa(i)), endpoint: e})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	return ring
+}
+
+// key extracts the configured hash key from the request. An empty key means that the request doesn't carry it.
+func (b *ringHashBalancer) key(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+	switch b.hashKey.Source {
+	case "path":
+		return r.URL.Path
+	case "header":
+		return r.Header.Get(b.hashKey.Name)
+	case "cookie":
+		if c, err := r.Cookie(b.hashKey.Name); err == nil {
+			return c.Value
+		}
+		return ""
+	default:
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return r.RemoteAddr
+		}
+		return host
+	}
+}
+
+func (b *ringHashBalancer) currentRing(endpoints []*endpoint) []ringPoint {
+	weights := make([]uint, len(endpoints))
+	for i, e := range endpoints {
+		weights[i] = e.effectiveWeight()
+	}
+	b.mutex.RLock()
+	if slices.Equal(b.members, endpoints) && slices.Equal(b.weights, weights) {
+		defer b.mutex.RUnlock()
+		return b.ring
+	}
+	b.mutex.RUnlock()
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if !slices.Equal(b.members, endpoints) || !slices.Equal(b.weights, weights) {
+		b.members = slices.Clone(endpoints)
+		b.weights = weights
+		b.ring = buildRing(endpoints)
+	}
+	return b.ring
+}
+
+func (b *ringHashBalancer) Next(endpoints []*endpoint, r *http.Request) (*endpoint, error) {
+	if len(endpoints) < 1 {
+		return nil, errNoEndpoints
+	}
+	key := b.key(r)
+	if key == "" {
+		// Requests without a key have no affinity to keep
+		return endpoints[rand.Intn(len(endpoints))], nil
+	}
+	ring := b.currentRing(endpoints)
+	if len(ring) == 0 {
+		return endpoints[rand.Intn(len(endpoints))], nil
+	}
+	h := hash64(key)
+	i := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= h })
+	if i == len(ring) {
+		i = 0
+	}
+	return ring[i].endpoint, nil
+}
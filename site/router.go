@@ -0,0 +1,257 @@
+package site
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/L1Cafe/lbx/config"
+	"github.com/L1Cafe/lbx/log"
+	"github.com/go-chi/chi/v5"
+)
+
+// hostRoute routes the requests of one domain on their path
+type hostRoute struct {
+	domain string
+	paths  pathSiteMap
+	// mux only matches the paths, the requests are served by the handlers of the port router
+	mux *chi.Mux
+	// regex is only set for regex domains
+	regex *regexp.Regexp
+}
+
+// portRouter routes the requests of a port on the Host header first, and then on the path. The domains that match the
+// host are tried from the most to the least specific: the exact domain, the wildcard domains from the longest to the
+// shortest, the regex domains in the order of the configuration file, and the sites without a domain. The first one
+// with a path matching the request serves it, and the requests that none of them match go to the fallback site of the
+// port.
+type portRouter struct {
+	exact map[string]*hostRoute
+	// wildcards are sorted from the longest to the shortest domain
+	wildcards []*hostRoute
+	regexes   []*hostRoute
+	anyHost   *hostRoute
+	fallback  *site
+	handlers  map[*site]http.Handler
+}
+
+func newPortRouter(routes *portRoutes) *portRouter {
+	pr := &portRouter{exact: map[string]*hostRoute{}, fallback: routes.fallback, handlers: map[*site]http.Handler{}}
+	for _, domain := range routes.domainOrder {
+		hr := &hostRoute{domain: domain, paths: routes.domains[domain], mux: chi.NewRouter()}
+		for p, pathSites := range hr.paths {
+			hr.mux.Handle(p, http.NotFoundHandler())
+			for _, s := range pathSites {
+				pr.handlers[s] = siteHandler(s)
+			}
+		}
+		switch {
+		case domain == "":
+			pr.anyHost = hr
+		case strings.HasPrefix(domain, "~"):
+			regex, err := config.DomainRegexp(domain)
+			if err != nil {
+				log.Wrapper(log.Fatal, fmt.Sprintf("Invalid regex domain %s: %s", domain, err.Error()))
+			}
+			hr.regex = regex
+			pr.regexes = append(pr.regexes, hr)
+		case strings.HasPrefix(domain, "*."):
+			pr.wildcards = append(pr.wildcards, hr)
+		default:
+			pr.exact[domain] = hr
+		}
+	}
+	if pr.fallback != nil {
+		pr.handlers[pr.fallback] = siteHandler(pr.fallback)
+	}
+	sort.SliceStable(pr.wildcards, func(i, j int) bool { return len(pr.wildcards[i].domain) > len(pr.wildcards[j].domain) })
+	return pr
+}
+
+// normalizeHost lowers the case of a host, and removes its port and trailing dot
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.Trim(host, "[]"), ".")
+	return strings.ToLower(host)
+}
+
+// requestHost is the normalized host of the request
+func requestHost(r *http.Request) string {
+	return normalizeHost(r.Host)
+}
+
+// candidates lists the domains that match the host, in order of precedence
+func (pr *portRouter) candidates(host string) []*hostRoute {
+	var matches []*hostRoute
+	if hr, ok := pr.exact[host]; ok {
+		matches = append(matches, hr)
+	}
+	for _, hr := range pr.wildcards {
+		// The wildcard matches any number of labels, but not the domain itself
+		if suffix := hr.domain[1:]; len(host) > len(suffix) && strings.HasSuffix(host, suffix) {
+			matches = append(matches, hr)
+		}
+	}
+	for _, hr := range pr.regexes {
+		if hr.regex.MatchString(host) {
+			matches = append(matches, hr)
+		}
+	}
+	if pr.anyHost != nil {
+		matches = append(matches, pr.anyHost)
+	}
+	return matches
+}
+
+// route returns the first site of the path matching the request that accepts it, or nil
+func (hr *hostRoute) route(r *http.Request) *site {
+	rctx := chi.NewRouteContext()
+	if !hr.mux.Match(rctx, r.Method, requestPath(r)) || len(rctx.RoutePatterns) == 0 {
+		return nil
+	}
+	for _, s := range hr.paths[rctx.RoutePatterns[len(rctx.RoutePatterns)-1]] {
+		if s.matches(r) {
+			return s
+		}
+	}
+	return nil
+}
+
+// requestPath is the path that chi routes the request on
+func requestPath(r *http.Request) string {
+	if r.URL.RawPath != "" {
+		return r.URL.RawPath
+	}
+	return r.URL.Path
+}
+
+func (pr *portRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, hr := range pr.candidates(requestHost(r)) {
+		if s := hr.route(r); s != nil {
+			pr.handlers[s].ServeHTTP(w, r)
+			return
+		}
+	}
+	if pr.fallback != nil {
+		pr.handlers[pr.fallback].ServeHTTP(w, r)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// overlaps describes the domains of the port that match some of the same hosts, and which of them takes precedence. A
+// regex domain is only compared with the exact domains, and with a host made up for each wildcard domain, as whether two
+// regexes overlap can't be told in general.
+func (pr *portRouter) overlaps() []string {
+	var found []string
+	describe := func(first string, second string, example string) {
+		found = append(found, fmt.Sprintf("%s takes precedence over %s for hosts such as %s", describeDomain(first), describeDomain(second), example))
+	}
+	exact := make([]string, 0, len(pr.exact))
+	for domain := range pr.exact {
+		exact = append(exact, domain)
+	}
+	sort.Strings(exact)
+	for _, domain := range exact {
+		for _, hr := range pr.candidates(domain) {
+			if hr.domain != domain && hr != pr.anyHost {
+				describe(domain, hr.domain, domain)
+			}
+		}
+	}
+	for i, wildcard := range pr.wildcards {
+		example := "lbx-example" + wildcard.domain[1:]
+		for _, hr := range pr.wildcards[i+1:] {
+			if strings.HasSuffix(wildcard.domain[1:], hr.domain[1:]) {
+				describe(wildcard.domain, hr.domain, example)
+			}
+		}
+		for _, hr := range pr.regexes {
+			if hr.regex.MatchString(example) {
+				describe(wildcard.domain, hr.domain, example)
+			}
+		}
+	}
+	return found
+}
+
+func describeDomain(domain string) string {
+	switch {
+	case domain == "":
+		return "any host"
+	case strings.HasPrefix(domain, "~"):
+		return "regex domain " + domain
+	case strings.HasPrefix(domain, "*."):
+		return "wildcard domain " + domain
+	}
+	return "domain " + domain
+}
+
+// explain describes which sites match a host and a path, in order of precedence, and which one serves a GET request
+// without headers, query parameters or cookies
+func (pr *portRouter) explain(host string, path string) string {
+	host = normalizeHost(host)
+	r, err := http.NewRequest(http.MethodGet, path, nil)
+	if err != nil {
+		return fmt.Sprintf("Invalid path %s: %s", path, err.Error())
+	}
+	r.Host = host
+	var b strings.Builder
+	fmt.Fprintf(&b, "Sites matching host %s, in order of precedence:\n", host)
+	var winner *site
+	n := 0
+	for _, hr := range pr.candidates(host) {
+		paths := make([]string, 0, len(hr.paths))
+		for p := range hr.paths {
+			paths = append(paths, p)
+		}
+		sort.Strings(paths)
+		for _, p := range paths {
+			for _, s := range hr.paths[p] {
+				n++
+				rules := ""
+				if s.match != nil {
+					rules = ", with match rules"
+				}
+				fmt.Fprintf(&b, "\t%d. site %s, path %s, %s%s\n", n, s.name, p, describeDomain(hr.domain), rules)
+			}
+		}
+		if winner == nil {
+			winner = hr.route(r)
+		}
+	}
+	if n == 0 {
+		b.WriteString("\tnone\n")
+	}
+	if pr.fallback != nil {
+		fmt.Fprintf(&b, "Fallback site: %s\n", pr.fallback.name)
+		if winner == nil {
+			winner = pr.fallback
+		}
+	}
+	if winner == nil {
+		fmt.Fprintf(&b, "No site serves path %s, the request gets a 404", path)
+	} else {
+		fmt.Fprintf(&b, "Path %s is served by site %s", path, winner.name)
+	}
+	return b.String()
+}
+
+// ExplainHost reports which of the sites listening on port match host, in order of precedence, and which one of them
+// serves a request for path. It helps finding out why a request doesn't reach the expected site when several wildcard
+// or regex domains overlap.
+func ExplainHost(port uint16, host string, path string) (string, error) {
+	registryMutex.RLock()
+	routes, ok := portMap[port]
+	registryMutex.RUnlock()
+	if !ok {
+		return "", errors.New(fmt.Sprintf("no site listens on port %d", port))
+	}
+	return newPortRouter(routes).explain(host, path), nil
+}
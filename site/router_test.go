@@ -0,0 +1,141 @@
+package site
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/L1Cafe/lbx/config"
+)
+
+// routedSite is a site with a single healthy endpoint that answers with the name of the site
+func routedSite(t *testing.T, name string, domain string, path string) *site {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, name)
+	}))
+	t.Cleanup(upstream.Close)
+	u, _ := url.Parse(upstream.URL)
+	s := newSite(name, config.SiteParsedConfig{
+		Endpoints:     []config.EndpointParsedConfig{{URL: *u, Weight: 1}},
+		RefreshPeriod: time.Second,
+		Domain:        domain,
+		Path:          path,
+		HealthCheck:   config.DefaultHealthCheck(),
+	})
+	for _, e := range s.endpoints {
+		e.health.recordCheck(nil, s.healthCheck)
+	}
+	s.updateHealthyEndpoints()
+	return s
+}
+
+func TestPortRouter(t *testing.T) {
+	a := routedSite(t, "a", "a.example.com", "/*")
+	b := routedSite(t, "b", "b.example.com", "/*")
+	bV2 := routedSite(t, "b_v2", "b.example.com", "/*")
+	bV2.match = &config.MatchParsedConfig{Headers: []config.ValueMatchParsedConfig{{Name: "X-Api-Version", Exact: "2"}}}
+	api := routedSite(t, "api", "", "/api/*")
+	fallback := routedSite(t, "fallback", "c.example.com", "/*")
+	tenants := routedSite(t, "tenants", "*.apps.example.com", "/*")
+	admin := routedSite(t, "admin", "*.admin.apps.example.com", "/*")
+	numbered := routedSite(t, "numbered", "~node-[0-9]+\\.example\\.com", "/*")
+	anyNode := routedSite(t, "any_node", "~node-.*", "/*")
+	routes := &portRoutes{
+		domains: map[string]pathSiteMap{
+			"a.example.com":                {"/*": {a}},
+			"b.example.com":                {"/*": {bV2, b}},
+			"":                             {"/api/*": {api}},
+			"c.example.com":                {"/*": {fallback}},
+			"*.apps.example.com":           {"/*": {tenants}},
+			"*.admin.apps.example.com":     {"/*": {admin}},
+			"~node-[0-9]+\\.example\\.com": {"/*": {numbered}},
+			"~node-.*":                     {"/*": {anyNode}},
+		},
+		domainOrder: []string{"a.example.com", "b.example.com", "", "c.example.com", "*.apps.example.com", "*.admin.apps.example.com", "~node-[0-9]+\\.example\\.com", "~node-.*"},
+		fallback:    fallback,
+	}
+	router := newPortRouter(routes)
+
+	for _, tc := range []struct {
+		host    string
+		path    string
+		version string
+		want    string
+	}{
+		{"a.example.com", "/", "", "a"},
+		{"B.Example.com:8080", "/x", "", "b"},
+		{"b.example.com", "/x", "2", "b_v2"},
+		{"b.example.com", "/x", "3", "b"},
+		{"a.example.com.", "/api/v1", "", "a"},
+		{"unknown.example.com", "/api/v1", "", "api"},
+		{"unknown.example.com", "/", "", "fallback"},
+		{"[::1]:8080", "/", "", "fallback"},
+		{"tenant1.apps.example.com", "/", "", "tenants"},
+		{"x.tenant1.apps.example.com", "/", "", "tenants"},
+		{"apps.example.com", "/", "", "fallback"},
+		{"x.admin.apps.example.com", "/", "", "admin"},
+		{"NODE-12.example.com", "/", "", "numbered"},
+		{"node-x.example.com", "/", "", "any_node"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		r.Host = tc.host
+		if tc.version != "" {
+			r.Header.Set("X-Api-Version", tc.version)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if got := w.Body.String(); got != tc.want {
+			t.Errorf("Expected %s%s to be routed to site %s, got %q", tc.host, tc.path, tc.want, got)
+		}
+	}
+
+	explanation := router.explain("x.admin.apps.example.com:8080", "/api/v1")
+	for _, want := range []string{
+		"1. site admin, path /*, wildcard domain *.admin.apps.example.com",
+		"2. site tenants, path /*, wildcard domain *.apps.example.com",
+		"3. site api, path /api/*, any host",
+		"Path /api/v1 is served by site admin",
+	} {
+		if !strings.Contains(explanation, want) {
+			t.Errorf("Expected the explanation to contain %q, got:\n%s", want, explanation)
+		}
+	}
+
+	overlaps := router.overlaps()
+	if len(overlaps) != 1 || overlaps[0] != "wildcard domain *.admin.apps.example.com takes precedence over wildcard domain *.apps.example.com for hosts such as lbx-example.admin.apps.example.com" {
+		t.Errorf("Expected the overlap of the wildcard domains to be reported, got %q", overlaps)
+	}
+	overlaps = newPortRouter(&portRoutes{
+		domains: map[string]pathSiteMap{
+			"node-1.example.com":           {"/*": {a}},
+			"*.example.com":                {"/*": {tenants}},
+			"~node-[0-9]+\\.example\\.com": {"/*": {numbered}},
+		},
+		domainOrder: []string{"node-1.example.com", "*.example.com", "~node-[0-9]+\\.example\\.com"},
+	}).overlaps()
+	for _, want := range []string{
+		"domain node-1.example.com takes precedence over wildcard domain *.example.com for hosts such as node-1.example.com",
+		"domain node-1.example.com takes precedence over regex domain ~node-[0-9]+\\.example\\.com for hosts such as node-1.example.com",
+	} {
+		if !slices.Contains(overlaps, want) {
+			t.Errorf("Expected the overlap %q to be reported, got %q", want, overlaps)
+		}
+	}
+	if len(overlaps) != 2 {
+		t.Errorf("Expected 2 overlaps, got %q", overlaps)
+	}
+
+	routes.fallback = nil
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Host = "unknown.example.com"
+	w := httptest.NewRecorder()
+	newPortRouter(routes).ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected a 404 for an unknown host without a fallback site, got %d", w.Code)
+	}
+}
@@ -6,38 +6,107 @@ import (
 	"fmt"
 	"github.com/L1Cafe/lbx/config"
 	"github.com/L1Cafe/lbx/log"
-	"github.com/go-chi/chi/v5"
-	"io"
-	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
 	"slices"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 )
 
-type pathSiteMap map[string]*site
+// pathSiteMap lists the sites of each path. The sites with match rules come first, in the order of the configuration
+// file, and the site without match rules, if any, comes last.
+type pathSiteMap map[string][]*site
+
+// portRoutes holds the sites served on a port, by domain and then by path. Sites without a domain serve any host.
+type portRoutes struct {
+	domains map[string]pathSiteMap
+	// domainOrder lists the domains in the order of the configuration file
+	domainOrder []string
+	// fallback serves the requests that no other site of the port matches, it can be nil
+	fallback *site
+}
+
+// endpoint is created once per configured endpoint of a site, and outlives the swaps of the healthy endpoints list
+type endpoint struct {
+	url    url.URL
+	weight uint
+	// inFlight is the number of requests currently being proxied to the endpoint
+	inFlight atomic.Int64
+	// latency is the moving average of the time it takes the endpoint to send back response headers
+	latency latency
+	health  endpointHealth
+	agent   agentState
+	// weightPercent is the share of the configured weight that the agent of the endpoint reported, 100 by default
+	weightPercent atomic.Uint32
+	// group is nil unless the site splits its traffic between endpoint groups
+	group *endpointGroup
+}
+
+func newEndpoint(u url.URL, weight uint) *endpoint {
+	e := &endpoint{url: u, weight: weight}
+	e.weightPercent.Store(100)
+	return e
+}
+
+// effectiveWeight is the weight of the endpoint as changed by its agent, in hundredths of the configured weight
+func (e *endpoint) effectiveWeight() uint {
+	return e.weight * uint(e.weightPercent.Load())
+}
 
 // healthyEndpoints is a thread-safe mutating structure that holds a list of the endpoints
 type healthyEndpoints struct {
 	mutex     *sync.RWMutex
-	endpoints *[]url.URL
+	endpoints *[]*endpoint
+	// draining holds the healthy endpoints that their agent drains, they only serve the clients pinned to them
+	draining []*endpoint
 }
 
 // site is a read-only structure that comes from the parameters defined in the configuration file
 type site struct {
 	name             string
-	endpoints        []url.URL
+	endpoints        []*endpoint
 	healthyEndpoints *healthyEndpoints
 	refreshPeriod    time.Duration
 	domain           string
 	path             string
 	port             uint16
+	balancer         Balancer
+	// sticky is nil unless sticky sessions are enabled for the site
+	sticky      *stickySessions
+	healthCheck config.HealthCheckParsedConfig
+	// outlierDetection is nil unless passive health checks are enabled for the site
+	outlierDetection *config.OutlierDetectionParsedConfig
+	// responseTimeout is how long the endpoints have to send their response headers, 0 when they have no limit
+	responseTimeout time.Duration
+	// ejectionMutex makes sure that concurrent ejections don't go over the maximum number of ejected endpoints
+	ejectionMutex sync.Mutex
+	// agentCheck is nil unless the endpoints have agents to poll
+	agentCheck *config.AgentCheckParsedConfig
+	// match is nil unless the site only serves some of the requests for its path
+	match *config.MatchParsedConfig
+	// rewrite is nil unless the site changes the path of the requests it forwards
+	rewrite *pathRewrite
+	// groups is empty unless the site splits its traffic between endpoint groups
+	groups []*endpointGroup
+	// groupSticky is nil unless clients are kept in their endpoint group
+	groupSticky *groupSticky
+	// mirror is nil unless the site copies requests to a shadow endpoint group
+	mirror *mirror
+	// kind is the type of the site: proxy, static or redirect
+	kind     string
+	static   *config.StaticParsedConfig
+	redirect *config.RedirectParsedConfig
+	// maintenance is nil unless the site has a maintenance page of its own
+	maintenance   *config.MaintenanceParsedConfig
+	inMaintenance atomic.Bool
+	// tls is nil unless the site has a certificate of its own
+	tls *config.SiteTLSParsedConfig
 }
 
 // Global variables
@@ -46,10 +115,14 @@ var sites map[string]*site
 
 // portMap contains the following:
 // - ports as keys
-// - a map of path:site as values
-// This determines on what port each site is serving data. Also, what path is each site responsible for.
-// Each path must only be claimed by one site at a time. If more than one site claim a path on the same port, the application quits with an error message.
-var portMap map[uint16]pathSiteMap
+// - the routes of the port as values, a map of domain:path:site and the fallback site of the port
+// This determines on what port each site is serving data. Also, what domain and path is each site responsible for.
+// Each path of a domain must only be claimed by one site at a time. If more than one site claim a path for the same domain on the same port, the application quits with an error message.
+var portMap map[uint16]*portRoutes
+
+// registryMutex guards sites and portMap, which Init and Stop replace while the admin API and the exported controls
+// read them
+var registryMutex sync.RWMutex
 
 // gracefulShutdown receives a "true" when goroutines need to stop running. Goroutines must start cleanup immediately, and exit as soon as possible.
 var gracefulShutdownChannel chan bool
@@ -69,17 +142,66 @@ var once sync.Once
 // running is initialised by Init to true, and then set to false by the gracefulShutdown function
 var running atomic.Bool
 
-func newSite(name string, endpoints []url.URL, refreshPeriod time.Duration, domain string, path string, port uint16) *site {
+// lookupSite returns the running site called name
+func lookupSite(name string) (*site, error) {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+	s, ok := sites[name]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("unknown site %s", name))
+	}
+	return s, nil
+}
+
+func newSite(name string, conf config.SiteParsedConfig) *site {
 	s := new(site)
 	s.name = name
-	s.endpoints = endpoints
-	s.refreshPeriod = refreshPeriod
-	s.domain = domain
-	s.path = path
-	s.port = port
+	for _, e := range conf.Endpoints {
+		s.endpoints = append(s.endpoints, newEndpoint(e.URL, e.Weight))
+	}
+	s.refreshPeriod = conf.RefreshPeriod
+	s.domain = conf.Domain
+	s.path = conf.Path
+	s.port = conf.Port
+	s.balancer = newBalancer(conf)
+	for _, gc := range conf.Groups {
+		g := &endpointGroup{name: gc.Name, balancer: newBalancer(conf)}
+		g.weight.Store(uint32(gc.Weight))
+		for _, e := range gc.Endpoints {
+			ne := newEndpoint(e.URL, e.Weight)
+			ne.group = g
+			s.endpoints = append(s.endpoints, ne)
+		}
+		s.groups = append(s.groups, g)
+	}
+	if conf.GroupSticky != nil {
+		s.groupSticky = newGroupSticky(conf.GroupSticky)
+	}
+	if conf.Mirror != nil {
+		s.mirror = newMirror(conf.Mirror, s.groups)
+	}
+	s.kind = conf.Type
+	s.static = conf.Static
+	s.redirect = conf.Redirect
+	s.maintenance = conf.Maintenance
+	s.inMaintenance.Store(conf.Maintenance != nil && conf.Maintenance.Enabled)
+	s.tls = conf.TLS
+	s.healthCheck = conf.HealthCheck
+	if s.healthCheck.Method == "" {
+		// The configuration didn't go through config.LoadConfig
+		s.healthCheck = config.DefaultHealthCheck()
+	}
+	s.outlierDetection = conf.OutlierDetection
+	s.responseTimeout = conf.ResponseTimeout
+	s.agentCheck = conf.AgentCheck
+	s.match = conf.Match
+	s.rewrite = newPathRewrite(conf)
+	if conf.StickySession != nil {
+		s.sticky = newStickySessions(name, conf.StickySession)
+	}
 	he := new(healthyEndpoints)
 	heM := new(sync.RWMutex)
-	heE := new([]url.URL)
+	heE := new([]*endpoint)
 	he.mutex = heM
 	he.endpoints = heE
 	s.healthyEndpoints = he
@@ -102,6 +224,10 @@ func Stop() {
 	log.Wrapper(log.Info, "Performing graceful shutdown...")
 	close(gracefulShutdownChannel)
 	close(signalChannel)
+	if acmeCancel != nil {
+		acmeCancel()
+		acmeCancel = nil
+	}
 	// Stop each running server
 	for _, e := range runningHttpServers {
 		e.Shutdown(context.Background())
@@ -109,12 +235,16 @@ func Stop() {
 	runningGoroutines.Wait()
 	log.Wrapper(log.Info, "All healthchecks stopped")
 	log.Wrapper(log.Info, "All HTTP servers stopped")
+	registryMutex.Lock()
 	sites = nil
 	portMap = nil
+	registryMutex.Unlock()
 	gracefulShutdownChannel = nil
 	runningGoroutines = sync.WaitGroup{}
 	runningHttpServers = nil
 	signalChannel = nil
+	healthCheckQueue = nil
+	pendingChecks = nil
 	running.Store(false)
 	log.Wrapper(log.Info, "Application stopped")
 	return
@@ -131,89 +261,238 @@ func Init(conf *config.ParsedConfig) {
 	gracefulShutdownChannel = make(chan bool)
 	signalChannel = make(chan os.Signal)
 	signal.Notify(signalChannel, os.Interrupt, syscall.SIGTERM)
+	registryMutex.Lock()
 	sites = map[string]*site{}
-	portMap = map[uint16]pathSiteMap{}
+	portMap = map[uint16]*portRoutes{}
+	tlsListeners = conf.TLS
+	healthCheckQueue = make(chan healthCheckJob, healthCheckQueueSize)
+	pendingChecks = map[healthCheckJob]bool{}
 	go signalHandler() // FIXME is this really the way to do this?
-	// Step 1: Read the config
-	for siteName, siteValue := range conf.Sites {
-		ns := newSite(siteName, siteValue.Endpoints, siteValue.RefreshPeriod, siteValue.Domain, siteValue.Path, siteValue.Port)
+	runningGoroutines.Add(1)
+	go healthCheckWorker(healthCheckQueue, gracefulShutdownChannel)
+	// Step 1: Read the config, in the order of the file as it decides the precedence of regex domains
+	for _, siteName := range conf.SiteOrder {
+		siteValue := conf.Sites[siteName]
+		ns := newSite(siteName, siteValue)
 		// Step 2: Add the sites to the sites map
 		sites[siteName] = ns
-		// Step 3: Add the port -> path:site to the portMap map
-		// Step 3.1: Check if port already exists
-		v, portExists := portMap[siteValue.Port]
-		// Step 3.2: If it does, check if path already exists
-		if portExists {
-			s, pathExists := v[siteValue.Path]
-			if pathExists {
-				// A path cannot be served by two sites under the same port
-				log.Wrapper(log.Fatal, fmt.Sprintf("Path %s defined twice or more for port %d.\nConflicting sites:\n\t%s\n\t%s", siteValue.Path, siteValue.Port, s.name, siteName))
-			} else {
-				// Step 3.2.2: If path doesn't exist, add it
-				portMap[siteValue.Port][siteValue.Path] = ns
+		// Step 3: Add the port -> domain:path:site to the portMap map
+		// Step 3.1: Check if port already exists, if it doesn't, add it
+		routes, portExists := portMap[siteValue.Port]
+		if !portExists {
+			routes = &portRoutes{domains: map[string]pathSiteMap{}}
+			portMap[siteValue.Port] = routes
+		}
+		// Step 3.2: Check if the domain already exists on the port, if it doesn't, add it
+		paths, domainExists := routes.domains[siteValue.Domain]
+		if !domainExists {
+			paths = pathSiteMap{}
+			routes.domains[siteValue.Domain] = paths
+			routes.domainOrder = append(routes.domainOrder, siteValue.Domain)
+		}
+		// Step 3.3: Check if path already exists for the domain, only one of its sites can go without match rules
+		pathSites := paths[siteValue.Path]
+		if n := len(pathSites); n > 0 && pathSites[n-1].match == nil {
+			if ns.match == nil {
+				// A path cannot be served by two sites for the same domain under the same port, unless they have match rules
+				log.Wrapper(log.Fatal, fmt.Sprintf("Path %s defined twice or more for domain %q on port %d.\nConflicting sites:\n\t%s\n\t%s", siteValue.Path, siteValue.Domain, siteValue.Port, pathSites[n-1].name, siteName))
 			}
+			// The site with match rules goes before the site without them
+			pathSites = slices.Insert(pathSites, n-1, ns)
 		} else {
-			// Step 3.3: If port doesn't exist, add it
-			psm := map[string]*site{}
-			psm[siteValue.Path] = ns
-			portMap[siteValue.Port] = psm
+			pathSites = append(pathSites, ns)
+		}
+		paths[siteValue.Path] = pathSites
+		if siteValue.Fallback {
+			routes.fallback = ns
+		}
+		// Step 4: Dispatch healthchecks, static and redirect sites have no endpoints to check
+		if len(ns.endpoints) > 0 {
+			log.Wrapper(log.Info, fmt.Sprintf("Dispatching health checks for site %s", siteName))
+			go ns.autoHealthCheck()
+		}
+	}
+	registryMutex.Unlock()
+	for port, routes := range portMap {
+		for _, overlap := range newPortRouter(routes).overlaps() {
+			log.Wrapper(log.Info, fmt.Sprintf("On port %d, %s", port, overlap))
 		}
-		// Step 4: Dispatch healthchecks
-		log.Wrapper(log.Info, fmt.Sprintf("Dispatching health checks for site %s", siteName))
-		go ns.autoHealthCheck()
+	}
+	// Step 5: Set up ACME for the domains of the TLS ports that have no certificate of their own
+	acmeManager = nil
+	var certificateDomains []string
+	if conf.ACME != nil {
+		for port := range tlsListeners {
+			if routes, ok := portMap[port]; ok {
+				certificateDomains = append(certificateDomains, acmeDomains(routes)...)
+			}
+		}
+		slices.Sort(certificateDomains)
+		certificateDomains = slices.Compact(certificateDomains)
+		ctx, cancel := context.WithCancel(context.Background())
+		acmeCancel = cancel
+		manager, err := newACMEManager(ctx, conf.ACME, certificateDomains)
+		if err != nil {
+			log.Wrapper(log.Fatal, fmt.Sprintf("Error setting up ACME: %s", err))
+		}
+		acmeManager = manager
 	}
 	for port := range portMap {
 		log.Wrapper(log.Info, fmt.Sprintf("Starting server for port %d", port))
-		// Step 5: Start servers
+		// Step 6: Start servers
 		go startServer(port)
 	}
+	// Step 7: Obtain the ACME certificates in the background, the challenges are answered by the servers
+	if acmeManager != nil {
+		if len(certificateDomains) == 0 {
+			log.Wrapper(log.Info, "ACME is enabled, but no domain on the TLS ports needs a certificate from it")
+		} else {
+			log.Wrapper(log.Info, fmt.Sprintf("Obtaining certificates from %s for domains %s", conf.ACME.DirectoryURL, strings.Join(certificateDomains, ", ")))
+		}
+		manager := acmeManager
+		for _, domain := range certificateDomains {
+			runningGoroutines.Add(1)
+			go func(domain string) {
+				defer runningGoroutines.Done()
+				obtainCertificate(manager, domain)
+			}(domain)
+		}
+	}
+	// Step 8: Start the admin server
+	if conf.Admin != nil {
+		log.Wrapper(log.Info, fmt.Sprintf("Starting admin server on %s", conf.Admin.Listen))
+		srv := &http.Server{Addr: conf.Admin.Listen, Handler: newAdminRouter()}
+		runningHttpServers = append(runningHttpServers, srv)
+		runningGoroutines.Add(1)
+		go startAdminServer(srv)
+	}
 	log.Wrapper(log.Info, "The application is ready.")
 }
 
 func siteHandler(site *site) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		endpoint, eErr := site.getRandomHealthyEndpoint()
-		if eErr != nil {
-			log.Wrapper(log.Warn, fmt.Sprintf("%s", eErr.Error()))
-			http.Error(w, "Error encountered when attempting to connect to upstream server, see server logs for details", http.StatusServiceUnavailable)
+		if site.inMaintenance.Load() {
+			site.serveMaintenance(w)
 			return
 		}
-		rPath := r.URL.Path
-		endpointR, eRErr := http.Get(endpoint.String() + rPath)
+		switch site.kind {
+		case "static":
+			site.serveStatic(w)
+			return
+		case "redirect":
+			site.serveRedirect(w, r)
+			return
+		}
+		var endpoint *endpoint
+		if site.sticky != nil {
+			endpoint = site.stickyEndpoint(r)
+		}
+		if endpoint == nil {
+			var eErr error
+			endpoint, eErr = site.nextEndpoint(r)
+			if eErr != nil {
+				log.Wrapper(log.Warn, fmt.Sprintf("%s", eErr.Error()))
+				http.Error(w, "Error encountered when attempting to connect to upstream server, see server logs for details", http.StatusServiceUnavailable)
+				return
+			}
+			if site.sticky != nil {
+				// Either the client was not pinned yet, or its endpoint is no longer healthy
+				http.SetCookie(w, site.sticky.newCookie(endpoint, r))
+			}
+			if site.groupSticky != nil && site.groupSticky.pinnedGroup(r) != endpoint.group.name {
+				http.SetCookie(w, site.groupSticky.newCookie(endpoint.group, r))
+			}
+		}
+		// The shadow request goes out before the primary one reads the request body
+		shadow := site.startMirror(r)
+		endpoint.inFlight.Add(1)
+		defer endpoint.inFlight.Add(-1)
+		outReq, oErr := newUpstreamRequest(r, endpoint.url, site.rewrite)
+		if oErr != nil {
+			shadow.finish(oErr)
+			log.Wrapper(log.Warn, fmt.Sprintf("%s", oErr.Error()))
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		outReq, deadline := withResponseDeadline(outReq, site.responseTimeout)
+		defer deadline.release()
+		start := time.Now()
+		endpointR, eRErr := upstreamTransport.RoundTrip(outReq)
+		eRErr = deadline.headersReceived(endpointR, eRErr)
 		if eRErr != nil {
+			shadow.finish(eRErr)
+			site.recordPassiveResult(endpoint, eRErr, 0)
+			// A client that went away says nothing about the endpoint
+			if !errors.Is(eRErr, context.Canceled) {
+				endpoint.latency.observeFailure()
+				if qErr := (healthCheckJob{site: site, endpoint: endpoint}).enqueue(); qErr != nil {
+					log.Wrapper(log.Warn, fmt.Sprintf("Could not queue a health check for endpoint %s of site %s: %s", endpoint.url.String(), site.name, qErr.Error()))
+				}
+			}
 			log.Wrapper(log.Warn, fmt.Sprintf("%s", eRErr.Error()))
+			if errors.Is(eRErr, errResponseTimeout) {
+				http.Error(w, "The upstream server did not answer in time, see server logs for details", http.StatusGatewayTimeout)
+				return
+			}
 			http.Error(w, "Error encountered when attempting to connect to upstream server, see server logs for details", http.StatusServiceUnavailable)
 			return
 		}
-		w.WriteHeader(endpointR.StatusCode)
-		for key, values := range endpointR.Header {
-			for _, value := range values {
-				w.Header().Add(key, value)
+		endpoint.latency.observe(time.Since(start))
+		site.recordPassiveResult(endpoint, nil, endpointR.StatusCode)
+		if endpointR.StatusCode == http.StatusSwitchingProtocols {
+			// The response isn't observed, so there is nothing to compare with the shadow response
+			shadow.finish(nil)
+			if err := switchProtocols(w, r, endpointR); err != nil {
+				log.Wrapper(log.Warn, fmt.Sprintf("Switching protocols for site %s, path %s, client %v, via %v failed: %s", site.name, r.URL, r.RemoteAddr, endpoint.url.Host, err))
 			}
+			return
 		}
 		defer endpointR.Body.Close()
-		if _, err := io.Copy(w, endpointR.Body); err != nil {
+		shadow.observe(endpointR)
+		err := copyResponse(w, endpointR)
+		shadow.finish(err)
+		if err != nil {
+			// The status line has already been sent, all that can be done is to log the failure
 			log.Wrapper(log.Warn, fmt.Sprintf("Failed to write response body: %s", err))
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
 		}
-		log.Wrapper(log.Info, fmt.Sprintf("Request for site %s, path %s, client %v, served via %v", site.name, r.URL, r.RemoteAddr, endpoint.Host))
+		log.Wrapper(log.Info, fmt.Sprintf("Request for site %s, path %s, client %v, served via %v", site.name, r.URL, r.RemoteAddr, endpoint.url.Host))
 	}
 }
 
 func startServer(port uint16) {
 	runningGoroutines.Add(1)
-	pathSite := portMap[port]
-	chiRouter := chi.NewRouter()
-	for p, s := range pathSite {
-		chiRouter.Get(p, siteHandler(s))
-	}
 	portString := strconv.Itoa(int(port))
+	registryMutex.RLock()
+	routes := portMap[port]
+	registryMutex.RUnlock()
+	router := newPortRouter(routes)
 	srv := http.Server{
 		Addr:    ":" + portString,
-		Handler: chiRouter,
+		Handler: router,
+	}
+	listener, isTLS := tlsListeners[port]
+	if !isTLS && acmeManager != nil {
+		// Answers the HTTP-01 challenges, the other requests are routed as usual
+		srv.Handler = acmeManager.HTTPHandler(router)
+	}
+	if isTLS {
+		cs, csErr := newCertificateStore(listener, routes, router)
+		if csErr != nil {
+			log.Wrapper(log.Fatal, fmt.Sprintf("Error starting server on port %d: %s", port, csErr))
+		}
+		srv.TLSConfig = newTLSConfig(listener, cs)
+		runningGoroutines.Add(1)
+		go cs.watchCertificates(gracefulShutdownChannel)
 	}
 	runningHttpServers = append(runningHttpServers, &srv)
-	err := srv.ListenAndServe()
+	var err error
+	if isTLS {
+		// The certificates come from the TLS config
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
 	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Wrapper(log.Fatal, fmt.Sprintf("Error starting server on port %d: %s", port, err))
 	} else if errors.Is(err, http.ErrServerClosed) {
@@ -223,89 +502,21 @@ func startServer(port uint16) {
 	}
 }
 
-// autoHealthCheck periodically checks the endpoints in the provided site name. Intended to be run as goroutine.
-func (s *site) autoHealthCheck() {
-	runningGoroutines.Add(1)
-	for {
-		currentHealthyEndpoints := new([]url.URL)
-		log.Wrapper(log.Info, fmt.Sprintf("Checking healthy endpoints for site %s", s.name))
-		for _, endpoint := range s.endpoints {
-			log.Wrapper(log.Info, fmt.Sprintf(
-				"Checking health status of endpoint %s for site %s", endpoint.String(), s.name))
-			err := isUrlHealthy(endpoint)
-			if err == nil {
-				*currentHealthyEndpoints = append(*currentHealthyEndpoints, endpoint)
-			}
-		}
-		s.healthyEndpoints.mutex.Lock()
-		// swap list of previously healthy endpoints with the list of currently healthy ones
-		s.healthyEndpoints.endpoints = currentHealthyEndpoints
-		s.healthyEndpoints.mutex.Unlock()
-		log.Wrapper(log.Info, fmt.Sprintf("Healthy endpoint list of site %s was updated", s.name))
-		select {
-
-		case <-gracefulShutdownChannel:
-			// Channel was closed
-			log.Wrapper(log.Info, fmt.Sprintf("Graceful shutdown requested, terminating %v healthchecks...", s.name))
-			defer runningGoroutines.Done()
-			return
-		case <-time.After(s.refreshPeriod):
-			// Do nothing, just wait		return
-		}
-	}
-}
-
-// healthCheck is an endpoint check that returns an error on any reading error as well as 500 error codes
-func isUrlHealthy(u url.URL) error {
-	httpClient := http.Client{Timeout: 5 * time.Second}
-	res, err := httpClient.Head(u.String())
-	if err != nil {
-		return err
-	}
-	if res.StatusCode >= 500 {
-		return fmt.Errorf("received %d status from %s", res.StatusCode, u.String())
-	}
-	return nil
-}
-
-func isEndpointListedHealthy(s string, u url.URL) bool {
-	// Skipping validation, this is supposed to be a safe environment
-	site := sites[s]
-	return slices.Contains(site.endpoints, u)
-}
-
-func queueSiteHealthCheck(s string) error {
-	// TODO queue an async check of the entire site, replace the list of healthy endpoints
-	return nil
-}
-
-func queueEndpointHealthCheck(s string, u url.URL) error {
-	// TODO queue an async check of a single endpoint from the list of healthy endpoints, remove from list of healthy endpoints if necessary
-	return nil
-}
-
-func markUnhealthy(s string, u url.URL) {
-	site := sites[s]
-	site.healthyEndpoints.mutex.Lock()
-	for _, su := range *site.healthyEndpoints.endpoints {
-		currentHealthyEndpoints := new([]url.URL)
-		if su != u {
-			*currentHealthyEndpoints = append(*currentHealthyEndpoints, su)
-		} else {
-			log.Wrapper(log.Info, fmt.Sprintf("Endpoint %s evicted from healthy endpoints list for site %s", u.String(), s))
-		}
-	}
-	site.healthyEndpoints.mutex.Unlock()
-}
-
-func (s *site) getRandomHealthyEndpoint() (url.URL, error) {
-	// Choosing server at random, currently the only load balancing algorithm
+// nextEndpoint asks the balancer of the site to choose one of the healthy endpoints. When the site has endpoint
+// groups, the group is chosen first, and its own balancer chooses among its healthy endpoints.
+func (s *site) nextEndpoint(r *http.Request) (*endpoint, error) {
 	s.healthyEndpoints.mutex.RLock()
-	defer s.healthyEndpoints.mutex.RUnlock()
 	hEL := *s.healthyEndpoints.endpoints
+	s.healthyEndpoints.mutex.RUnlock()
 	if len(hEL) < 1 {
-		return url.URL{}, errors.New(fmt.Sprintf("No healthy endpoints available for site %s", s.name))
+		return nil, errors.New(fmt.Sprintf("No healthy endpoints available for site %s", s.name))
+	}
+	if len(s.groups) > 0 {
+		g, members := s.chooseGroup(hEL, r)
+		if g == nil {
+			return nil, errors.New(fmt.Sprintf("No endpoint group with healthy endpoints and a weight above 0 for site %s", s.name))
+		}
+		return g.balancer.Next(members, r)
 	}
-	index := rand.Intn(len(*s.healthyEndpoints.endpoints))
-	return (*s.healthyEndpoints.endpoints)[index], nil
+	return s.balancer.Next(hEL, r)
 }
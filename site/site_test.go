@@ -1,8 +1,19 @@
 package site
 
 import (
+	"errors"
+	"fmt"
+	"github.com/L1Cafe/lbx/config"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"reflect"
+	"regexp"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestIsUrlHealthy(t *testing.T) {
@@ -18,3 +29,180 @@ func TestIsUrlHealthy(t *testing.T) {
 		t.Error("Testing for a non-existant site found a working site")
 	}
 }
+
+func TestHttpCheck(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/healthz" && r.Host == "internal.example.com" && r.Header.Get("X-Probe") == "lbx":
+			_, _ = io.WriteString(w, "status: ok")
+		case r.URL.Path == "/healthz":
+			http.Error(w, "unexpected host or header", http.StatusBadRequest)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+
+	hc := config.DefaultHealthCheck()
+	hc.Path = "/missing"
+	hc.ExpectedStatuses = []config.StatusRange{{Min: 200, Max: 399}}
+	if err := httpCheck(*u, hc); err == nil {
+		t.Error("A 404 was accepted as healthy although only 2xx and 3xx are expected")
+	}
+
+	hc.Path = "/healthz"
+	hc.Method = http.MethodGet
+	hc.Headers = map[string]string{"Host": "internal.example.com", "X-Probe": "lbx"}
+	hc.BodyRegex = regexp.MustCompile(`status: (ok|degraded)`)
+	if err := httpCheck(*u, hc); err != nil {
+		t.Errorf("Expected the endpoint to be healthy, got %s", err)
+	}
+	hc.Body = "status: degraded"
+	if err := httpCheck(*u, hc); err == nil {
+		t.Error("A response without the expected body substring was accepted as healthy")
+	}
+}
+
+func TestHealthThresholds(t *testing.T) {
+	hc := config.DefaultHealthCheck()
+	failed := errors.New("check failed")
+	var h endpointHealth
+	steps := []struct {
+		err      error
+		expected healthState
+	}{
+		{nil, stateHealthy}, // The first check decides on its own
+		{failed, stateHealthy},
+		{failed, stateHealthy},
+		{nil, stateHealthy}, // A success resets the streak of failures
+		{failed, stateHealthy},
+		{failed, stateHealthy},
+		{failed, stateUnhealthy},
+		{nil, stateRecovering},
+		{failed, stateUnhealthy}, // A failure while recovering starts over
+		{nil, stateRecovering},
+		{nil, stateHealthy},
+	}
+	for i, step := range steps {
+		if _, to, _ := h.recordCheck(step.err, hc); to != step.expected {
+			t.Errorf("Check %d: expected the endpoint to be %s, got %s", i, step.expected, to)
+		}
+	}
+}
+
+func TestConcurrentHealthChecks(t *testing.T) {
+	var inFlight, maxInFlight atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			m := maxInFlight.Load()
+			if n <= m || maxInFlight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer upstream.Close()
+	var endpoints []config.EndpointParsedConfig
+	for i := 0; i < 12; i++ {
+		u, _ := url.Parse(fmt.Sprintf("%s/%d", upstream.URL, i))
+		endpoints = append(endpoints, config.EndpointParsedConfig{URL: *u, Weight: 1})
+	}
+	hc := config.DefaultHealthCheck()
+	hc.Concurrency = 4
+	s := newSite("concurrency_test", config.SiteParsedConfig{Endpoints: endpoints, RefreshPeriod: time.Second, HealthCheck: hc})
+	start := time.Now()
+	s.checkEndpoints(s.endpoints)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Checking 12 endpoints 4 at a time took %v", elapsed)
+	}
+	if maxInFlight.Load() > 4 {
+		t.Errorf("Expected at most 4 checks at the same time, got %d", maxInFlight.Load())
+	}
+	for _, e := range s.endpoints {
+		if e.health.current() != stateHealthy {
+			t.Errorf("Endpoint %s was not checked", e.url.String())
+		}
+	}
+}
+
+func TestHealthCheckBackoff(t *testing.T) {
+	hc := config.DefaultHealthCheck()
+	failed := errors.New("check failed")
+	var h endpointHealth
+	var intervals []time.Duration
+	for i := 0; i < 8; i++ {
+		h.recordCheck(failed, hc)
+		h.scheduleNextCheck(time.Second, 10*time.Second, hc.UnhealthyThreshold)
+		interval := time.Until(h.nextCheck).Round(time.Second)
+		if h.nextCheck.IsZero() {
+			interval = 0
+		}
+		intervals = append(intervals, interval)
+	}
+	expected := []time.Duration{0, 0, 0, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	if !reflect.DeepEqual(intervals, expected) {
+		t.Errorf("Expected check intervals %v, got %v", expected, intervals)
+	}
+	if h.dueForCheck(time.Now()) {
+		t.Error("An endpoint that is backing off was due for a check")
+	}
+	h.recordCheck(nil, hc)
+	h.scheduleNextCheck(time.Second, 10*time.Second, hc.UnhealthyThreshold)
+	if !h.dueForCheck(time.Now()) {
+		t.Error("A recovering endpoint must be checked every period")
+	}
+}
+
+func TestTcpCheck(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+	hc := config.DefaultHealthCheck()
+	hc.Type = "tcp"
+	hc.Timeout = time.Second
+	u, _ := url.Parse("http://" + l.Addr().String())
+	if err := tcpCheck(*u, hc); err != nil {
+		t.Errorf("Expected the TCP check to succeed, got %s", err)
+	}
+	// The listener doesn't speak TLS, so the handshake fails
+	u.Scheme = "https"
+	if err := tcpCheck(*u, hc); err == nil {
+		t.Error("A TLS check succeeded against a listener that doesn't speak TLS")
+	}
+	_ = l.Close()
+	u.Scheme = "http"
+	if err := tcpCheck(*u, hc); err == nil {
+		t.Error("A TCP check succeeded against a closed port")
+	}
+}
+
+func TestParkedEndpoint(t *testing.T) {
+	a, _ := url.Parse("http://a:80")
+	b, _ := url.Parse("http://b:80")
+	s := newSite("parked_test", config.SiteParsedConfig{
+		Endpoints:     []config.EndpointParsedConfig{{URL: *a, Weight: 1}, {URL: *b, Weight: 0}},
+		RefreshPeriod: time.Second,
+		Path:          "/*",
+		HealthCheck:   config.DefaultHealthCheck(),
+	})
+	for _, e := range s.endpoints {
+		e.health.recordCheck(nil, s.healthCheck)
+	}
+	s.updateHealthyEndpoints()
+	if hEL := *s.healthyEndpoints.endpoints; len(hEL) != 1 || hEL[0].url.Host != "a:80" {
+		t.Errorf("Expected the endpoint with a weight of 0 to get no traffic, got %d healthy endpoints", len(hEL))
+	}
+}
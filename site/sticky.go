@@ -0,0 +1,85 @@
+package site
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"slices"
+	"sync"
+
+	"github.com/L1Cafe/lbx/config"
+)
+
+// stickySessions pins a client to an endpoint with a cookie that holds an opaque ID of the endpoint. The ID is an HMAC
+// of the site name and the endpoint URL, so that clients don't learn the addresses of the endpoints, can't point lbx
+// at arbitrary URLs, and can't reuse a cookie across sites.
+type stickySessions struct {
+	site   string
+	cookie string
+	secret []byte
+	maxAge int
+	// ids caches the ID of each endpoint URL
+	ids sync.Map
+}
+
+// stickyIDSize is the number of bytes of the HMAC that make the ID of an endpoint
+const stickyIDSize = 16
+
+func newStickySessions(site string, conf *config.StickySessionParsedConfig) *stickySessions {
+	ss := &stickySessions{site: site, cookie: conf.Cookie, secret: []byte(conf.Secret), maxAge: int(conf.MaxAge.Seconds())}
+	if len(ss.secret) == 0 {
+		ss.secret = make([]byte, 32)
+		_, _ = rand.Read(ss.secret)
+	}
+	return ss
+}
+
+// id returns the opaque ID of an endpoint URL
+func (ss *stickySessions) id(endpointURL string) string {
+	if id, ok := ss.ids.Load(endpointURL); ok {
+		return id.(string)
+	}
+	mac := hmac.New(sha256.New, ss.secret)
+	mac.Write([]byte(ss.site + "\n" + endpointURL))
+	id := base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:stickyIDSize])
+	ss.ids.Store(endpointURL, id)
+	return id
+}
+
+// newCookie returns the cookie that pins the client to e
+func (ss *stickySessions) newCookie(e *endpoint, r *http.Request) *http.Cookie {
+	return &http.Cookie{
+		Name:     ss.cookie,
+		Value:    ss.id(e.url.String()),
+		Path:     "/",
+		MaxAge:   ss.maxAge,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// stickyEndpoint returns the endpoint that the client is pinned to, as long as it is still healthy and its endpoint
+// group, if any, still gets traffic
+func (s *site) stickyEndpoint(r *http.Request) *endpoint {
+	c, err := r.Cookie(s.sticky.cookie)
+	if err != nil {
+		return nil
+	}
+	s.healthyEndpoints.mutex.RLock()
+	defer s.healthyEndpoints.mutex.RUnlock()
+	// A draining endpoint keeps its pinned clients
+	candidates := append(slices.Clip(*s.healthyEndpoints.endpoints), s.healthyEndpoints.draining...)
+	for _, e := range candidates {
+		if subtle.ConstantTimeCompare([]byte(s.sticky.id(e.url.String())), []byte(c.Value)) == 1 {
+			if e.group != nil && e.group.weight.Load() == 0 {
+				return nil
+			}
+			return e
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package site
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/L1Cafe/lbx/config"
+)
+
+func TestStickySessions(t *testing.T) {
+	var endpoints []config.EndpointParsedConfig
+	for _, name := range []string{"one", "two"} {
+		name := name
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, name)
+		}))
+		defer upstream.Close()
+		u, _ := url.Parse(upstream.URL)
+		endpoints = append(endpoints, config.EndpointParsedConfig{URL: *u, Weight: 1})
+	}
+	s := newSite("sticky_test", config.SiteParsedConfig{
+		Endpoints:     endpoints,
+		RefreshPeriod: time.Second,
+		Path:          "/*",
+		Algorithm:     "round_robin",
+		StickySession: &config.StickySessionParsedConfig{Cookie: "lbx_sticky", Secret: "secret"},
+	})
+	*s.healthyEndpoints.endpoints = s.endpoints
+	serve := func(cookie *http.Cookie) (string, *http.Cookie) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		siteHandler(s)(rec, req)
+		body, _ := io.ReadAll(rec.Result().Body)
+		var newCookie *http.Cookie
+		for _, c := range rec.Result().Cookies() {
+			if c.Name == "lbx_sticky" {
+				newCookie = c
+			}
+		}
+		return string(body), newCookie
+	}
+
+	pinnedTo, cookie := serve(nil)
+	if cookie == nil {
+		t.Fatal("Expected a sticky cookie on the first request")
+	}
+	for i := 0; i < 5; i++ {
+		servedBy, newCookie := serve(cookie)
+		if servedBy != pinnedTo {
+			t.Errorf("Expected the pinned endpoint %s to serve the request, got %s", pinnedTo, servedBy)
+		}
+		if newCookie != nil {
+			t.Error("The client was re-pinned although its endpoint is healthy")
+		}
+	}
+
+	for _, e := range s.endpoints {
+		if strings.Contains(cookie.Value, e.url.Host) || strings.Contains(cookie.Value, base64.RawURLEncoding.EncodeToString([]byte(e.url.String()))) {
+			t.Errorf("The sticky cookie %s reveals the endpoint %s", cookie.Value, e.url.String())
+		}
+	}
+	tampered := *cookie
+	tampered.Value = base64.RawURLEncoding.EncodeToString([]byte(s.endpoints[0].url.String()))
+	if _, newCookie := serve(&tampered); newCookie == nil {
+		t.Error("A cookie with an invalid signature was accepted")
+	}
+
+	// Draining the pinned endpoint keeps its client there, while the new clients go to the other endpoint
+	pinned := s.stickyEndpoint(cookieRequest(cookie))
+	for _, e := range s.endpoints {
+		e.health.recordCheck(nil, s.healthCheck)
+	}
+	if _, err := pinned.applyAgentReply("drain"); err != nil {
+		t.Fatalf("%s", err)
+	}
+	s.updateHealthyEndpoints()
+	for i := 0; i < 3; i++ {
+		servedBy, newCookie := serve(cookie)
+		if servedBy != pinnedTo {
+			t.Errorf("Expected the drained endpoint %s to keep serving its pinned client, got %s", pinnedTo, servedBy)
+		}
+		if newCookie != nil {
+			t.Error("The client was re-pinned although its endpoint is only draining")
+		}
+		if servedBy, _ := serve(nil); servedBy == pinnedTo {
+			t.Error("A drained endpoint got a new client")
+		}
+	}
+	if _, err := pinned.applyAgentReply("ready"); err != nil {
+		t.Fatalf("%s", err)
+	}
+	s.updateHealthyEndpoints()
+
+	// Evicting the pinned endpoint falls back to the balancer and re-pins the client
+	for _, e := range s.endpoints {
+		if e != pinned {
+			*s.healthyEndpoints.endpoints = []*endpoint{e}
+		}
+	}
+	servedBy, newCookie := serve(cookie)
+	if servedBy == pinnedTo {
+		t.Error("An evicted endpoint served a pinned request")
+	}
+	if newCookie == nil {
+		t.Fatal("Expected the client to be re-pinned after its endpoint was evicted")
+	}
+	if again, _ := serve(newCookie); again != servedBy {
+		t.Errorf("Expected the new pinned endpoint %s to serve the request, got %s", servedBy, again)
+	}
+}
+
+func cookieRequest(c *http.Cookie) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(c)
+	return req
+}
@@ -0,0 +1,186 @@
+package site
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/L1Cafe/lbx/config"
+	"github.com/L1Cafe/lbx/log"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// certificateCheckPeriod is how often the certificate files are checked for changes
+const certificateCheckPeriod = 10 * time.Second
+
+// tlsListeners holds the TLS settings of the ports that serve HTTPS
+var tlsListeners map[uint16]config.TLSListenerParsedConfig
+
+// fileStamp tells whether a file changed since it was last read
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func stampFile(name string) (fileStamp, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{modTime: info.ModTime(), size: info.Size()}, nil
+}
+
+// reloadableCertificate is a certificate that is read again when its files change on disk. Handshakes use the last
+// certificate that loaded, so existing connections and failed reloads don't affect them.
+type reloadableCertificate struct {
+	cert    string
+	key     string
+	current atomic.Pointer[tls.Certificate]
+	// mutex guards attempted, the stamps of the files at the last load attempt, so that a broken pair is only tried
+	// again once one of its files changes
+	mutex     sync.Mutex
+	attempted [2]fileStamp
+}
+
+func loadCertificate(cert string, key string) (*reloadableCertificate, error) {
+	rc := &reloadableCertificate{cert: cert, key: key}
+	rc.attempted = rc.stamps()
+	certificate, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return nil, err
+	}
+	rc.current.Store(&certificate)
+	return rc, nil
+}
+
+func (rc *reloadableCertificate) stamps() [2]fileStamp {
+	// A missing file reads as a zero stamp, which fails to load like any other broken pair
+	certStamp, _ := stampFile(rc.cert)
+	keyStamp, _ := stampFile(rc.key)
+	return [2]fileStamp{certStamp, keyStamp}
+}
+
+// reload loads the certificate again if its files changed. When the new files don't load, the previous certificate
+// is kept.
+func (rc *reloadableCertificate) reload() {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	stamps := rc.stamps()
+	if stamps == rc.attempted {
+		return
+	}
+	rc.attempted = stamps
+	certificate, err := tls.LoadX509KeyPair(rc.cert, rc.key)
+	if err != nil {
+		log.Wrapper(log.Warn, fmt.Sprintf("Reloading certificate %s failed, keeping the previous one: %s", rc.cert, err.Error()))
+		return
+	}
+	rc.current.Store(&certificate)
+	log.Wrapper(log.Info, fmt.Sprintf("Certificate %s was reloaded", rc.cert))
+}
+
+// certificateStore chooses the certificate of a TLS port by SNI. The server name goes through the same domain
+// precedence as the Host header, and the first matching domain with a certificate of its own, or with an ACME
+// certificate, wins. The default certificate of the port is used otherwise.
+type certificateStore struct {
+	router       *portRouter
+	certificates map[string]*reloadableCertificate
+	// defaultCertificate can only be nil when ACME is enabled
+	defaultCertificate *reloadableCertificate
+	// acme is nil unless ACME is enabled, and acmeDomains are the domains of the port that it has certificates for
+	acme        *autocert.Manager
+	acmeDomains map[string]bool
+}
+
+func newCertificateStore(listener config.TLSListenerParsedConfig, routes *portRoutes, router *portRouter) (*certificateStore, error) {
+	cs := &certificateStore{router: router, certificates: map[string]*reloadableCertificate{}, acme: acmeManager, acmeDomains: map[string]bool{}}
+	if listener.Cert != "" {
+		defaultCertificate, err := loadCertificate(listener.Cert, listener.Key)
+		if err != nil {
+			return nil, fmt.Errorf("loading the default certificate %s: %w", listener.Cert, err)
+		}
+		cs.defaultCertificate = defaultCertificate
+	}
+	if cs.acme != nil {
+		for _, domain := range acmeDomains(routes) {
+			cs.acmeDomains[domain] = true
+		}
+	}
+	for domain, paths := range routes.domains {
+		for _, pathSites := range paths {
+			for _, s := range pathSites {
+				if s.tls == nil || cs.certificates[domain] != nil {
+					continue
+				}
+				certificate, err := loadCertificate(s.tls.Cert, s.tls.Key)
+				if err != nil {
+					return nil, fmt.Errorf("loading the certificate %s of site %s: %w", s.tls.Cert, s.name, err)
+				}
+				cs.certificates[domain] = certificate
+			}
+		}
+	}
+	return cs, nil
+}
+
+func (cs *certificateStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cs.acme != nil && isACMEChallenge(hello) {
+		return cs.acme.GetCertificate(hello)
+	}
+	if host := normalizeHost(hello.ServerName); host != "" {
+		for _, hr := range cs.router.candidates(host) {
+			if certificate, ok := cs.certificates[hr.domain]; ok {
+				return certificate.current.Load(), nil
+			}
+			if cs.acmeDomains[hr.domain] {
+				return cs.acme.GetCertificate(hello)
+			}
+		}
+	}
+	if cs.defaultCertificate == nil {
+		return nil, errors.New(fmt.Sprintf("no certificate for server name %q", hello.ServerName))
+	}
+	return cs.defaultCertificate.current.Load(), nil
+}
+
+// reload checks every certificate of the store for changes, the ACME certificates are renewed by their manager
+func (cs *certificateStore) reload() {
+	if cs.defaultCertificate != nil {
+		cs.defaultCertificate.reload()
+	}
+	for _, certificate := range cs.certificates {
+		certificate.reload()
+	}
+}
+
+// watchCertificates reloads the certificates of the store when their files change, until shutdown. The caller adds
+// the goroutine to runningGoroutines.
+func (cs *certificateStore) watchCertificates(shutdown chan bool) {
+	defer runningGoroutines.Done()
+	for {
+		select {
+		case <-shutdown:
+			return
+		case <-time.After(certificateCheckPeriod):
+			cs.reload()
+		}
+	}
+}
+
+func newTLSConfig(listener config.TLSListenerParsedConfig, cs *certificateStore) *tls.Config {
+	tlsConfig := &tls.Config{
+		MinVersion:     listener.MinVersion,
+		CipherSuites:   listener.CipherSuites,
+		GetCertificate: cs.getCertificate,
+	}
+	if cs.acme != nil {
+		// Answers the TLS-ALPN-01 challenges, the HTTP protocols are added by the server
+		tlsConfig.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+	}
+	return tlsConfig
+}
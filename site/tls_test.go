@@ -0,0 +1,153 @@
+package site
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/L1Cafe/lbx/config"
+)
+
+// writeTestCertificate writes a self-signed certificate for dnsNames and its key to dir
+func writeTestCertificate(t *testing.T, dir string, name string, dnsNames ...string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("%s", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600); err != nil {
+		t.Fatalf("%s", err)
+	}
+	return certFile, keyFile
+}
+
+func TestCertificateBySNI(t *testing.T) {
+	dir := t.TempDir()
+	defaultCert, defaultKey := writeTestCertificate(t, dir, "default", "default.example.com")
+	shopCert, shopKey := writeTestCertificate(t, dir, "shop", "shop.example.com")
+	appsCert, appsKey := writeTestCertificate(t, dir, "apps", "*.apps.example.com")
+	shop := routedSite(t, "shop", "shop.example.com", "/*")
+	shop.tls = &config.SiteTLSParsedConfig{Cert: shopCert, Key: shopKey}
+	apps := routedSite(t, "apps", "*.apps.example.com", "/*")
+	apps.tls = &config.SiteTLSParsedConfig{Cert: appsCert, Key: appsKey}
+	plain := routedSite(t, "plain", "plain.example.com", "/*")
+	routes := &portRoutes{
+		domains: map[string]pathSiteMap{
+			"shop.example.com":   {"/*": {shop}},
+			"*.apps.example.com": {"/*": {apps}},
+			"plain.example.com":  {"/*": {plain}},
+		},
+		domainOrder: []string{"shop.example.com", "*.apps.example.com", "plain.example.com"},
+	}
+	listener := config.TLSListenerParsedConfig{Cert: defaultCert, Key: defaultKey, MinVersion: tls.VersionTLS12}
+	router := newPortRouter(routes)
+	cs, err := newCertificateStore(listener, routes, router)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	server := httptest.NewUnstartedServer(router)
+	server.TLS = newTLSConfig(listener, cs)
+	server.StartTLS()
+	defer server.Close()
+
+	for serverName, want := range map[string]string{
+		"shop.example.com":        "shop.example.com",
+		"SHOP.example.com":        "shop.example.com",
+		"tenant.apps.example.com": "*.apps.example.com",
+		"plain.example.com":       "default.example.com",
+		"unknown.example.com":     "default.example.com",
+	} {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{ServerName: serverName, InsecureSkipVerify: true}}}
+		req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+		req.Host = serverName
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		res.Body.Close()
+		if got := res.TLS.PeerCertificates[0].DNSNames[0]; got != want {
+			t.Errorf("Expected the certificate of %s for server name %s, got %s", want, serverName, got)
+		}
+	}
+
+	if _, err := newCertificateStore(config.TLSListenerParsedConfig{Cert: filepath.Join(dir, "missing.crt"), Key: defaultKey}, routes, router); err == nil {
+		t.Error("Expected an error when the default certificate can't be loaded")
+	}
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := writeTestCertificate(t, dir, "default", "old.example.com")
+	routes := &portRoutes{domains: map[string]pathSiteMap{}}
+	cs, err := newCertificateStore(config.TLSListenerParsedConfig{Cert: cert, Key: key}, routes, newPortRouter(routes))
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	served := func() string {
+		certificate, _ := cs.getCertificate(&tls.ClientHelloInfo{ServerName: "old.example.com"})
+		leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		return leaf.DNSNames[0]
+	}
+	// Makes sure that the files look changed, whatever the resolution of modification times
+	touch := func() {
+		later := time.Now().Add(time.Minute)
+		for _, f := range []string{cert, key} {
+			if err := os.Chtimes(f, later, later); err != nil {
+				t.Fatalf("%s", err)
+			}
+		}
+	}
+
+	cs.reload()
+	if got := served(); got != "old.example.com" {
+		t.Fatalf("Expected the initial certificate, got %s", got)
+	}
+	writeTestCertificate(t, dir, "default", "new.example.com")
+	touch()
+	cs.reload()
+	if got := served(); got != "new.example.com" {
+		t.Errorf("Expected the rotated certificate after a reload, got %s", got)
+	}
+	if err := os.WriteFile(key, []byte("not a key"), 0o600); err != nil {
+		t.Fatalf("%s", err)
+	}
+	touch()
+	cs.reload()
+	if got := served(); got != "new.example.com" {
+		t.Errorf("Expected a broken key to keep the previous certificate, got %s", got)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
 	"github.com/L1Cafe/lbx/config"
 	"net/url"
@@ -72,6 +73,172 @@ func TestBadLogging(t *testing.T) {
 	}
 }
 
+func TestBadAlgorithm(t *testing.T) {
+	_, err := config.LoadConfig("bad_algorithm.yaml")
+	if err == nil {
+		t.Fatal("An unknown algorithm was accepted in bad_algorithm.yaml")
+	}
+	if !strings.Contains(err.Error(), "unknown algorithm") {
+		t.Errorf("Unexpected error. Expected an unknown algorithm error, got %s", err.Error())
+	}
+}
+
+func TestBadHashKey(t *testing.T) {
+	_, err := config.LoadConfig("bad_hash_key.yaml")
+	if err == nil {
+		t.Fatal("A header hash key without a header name was accepted in bad_hash_key.yaml")
+	}
+	if !strings.Contains(err.Error(), "invalid hash_key") {
+		t.Errorf("Unexpected error. Expected an invalid hash_key error, got %s", err.Error())
+	}
+}
+
+func TestBadHashKeyAlgorithm(t *testing.T) {
+	_, err := config.LoadConfig("bad_hash_key_algorithm.yaml")
+	if err == nil {
+		t.Fatal("A hash key with the round_robin algorithm was accepted in bad_hash_key_algorithm.yaml")
+	}
+	if !strings.Contains(err.Error(), "only the ring_hash algorithm uses it") {
+		t.Errorf("Unexpected error. Expected an error about the unused hash_key, got %s", err.Error())
+	}
+}
+
+func TestBadHealthCheck(t *testing.T) {
+	_, err := config.LoadConfig("bad_health_check.yaml")
+	if err == nil {
+		t.Fatal("An invalid status range was accepted in bad_health_check.yaml")
+	}
+	if !strings.Contains(err.Error(), "not a valid status code") {
+		t.Errorf("Unexpected error. Expected an invalid status code error, got %s", err.Error())
+	}
+}
+
+func TestTcpHealthCheck(t *testing.T) {
+	_, err := config.LoadConfig("bad_tcp_health_check.yaml")
+	if err == nil {
+		t.Fatal("A TCP health check with an HTTP path was accepted in bad_tcp_health_check.yaml")
+	}
+	if !strings.Contains(err.Error(), "only used by http health checks") {
+		t.Errorf("Unexpected error. Expected an error about HTTP settings, got %s", err.Error())
+	}
+}
+
+func TestDuplicateFallback(t *testing.T) {
+	_, err := config.LoadConfig("duplicate_fallback.yaml")
+	if err == nil {
+		t.Fatal("Two fallback sites on the same port were accepted in duplicate_fallback.yaml")
+	}
+	if !strings.Contains(err.Error(), "sites a and b are both the fallback of port 8081") {
+		t.Errorf("Unexpected error. Expected an error about the fallback sites, got %s", err.Error())
+	}
+}
+
+func TestDefaultFallback(t *testing.T) {
+	_, err := config.LoadConfig("default_fallback.yaml")
+	if err == nil {
+		t.Fatal("A fallback default site was accepted in default_fallback.yaml")
+	}
+	if !strings.Contains(err.Error(), "site default cannot be a fallback site") {
+		t.Errorf("Unexpected error. Expected an error about the default site, got %s", err.Error())
+	}
+}
+
+func TestBadDomain(t *testing.T) {
+	for file, want := range map[string]string{
+		"bad_wildcard_domain.yaml": "wildcard domain tenant.*.example.com can only have a \"*.\" prefix",
+		"bad_regex_domain.yaml":    "invalid domain for site regex",
+	} {
+		_, err := config.LoadConfig(file)
+		if err == nil {
+			t.Errorf("An invalid domain was accepted in %s", file)
+			continue
+		}
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Unexpected error for %s. Expected an error containing %q, got %s", file, want, err.Error())
+		}
+	}
+}
+
+func TestBadMatch(t *testing.T) {
+	_, err := config.LoadConfig("bad_match.yaml")
+	if err == nil {
+		t.Fatal("A header rule with both exact and prefix was accepted in bad_match.yaml")
+	}
+	if !strings.Contains(err.Error(), "header rule X-Api-Version can only have one of exact, prefix and regex") {
+		t.Errorf("Unexpected error. Expected an error about the header rule, got %s", err.Error())
+	}
+}
+
+func TestBadRewrite(t *testing.T) {
+	_, err := config.LoadConfig("bad_rewrite.yaml")
+	if err == nil {
+		t.Fatal("An invalid rewrite regex was accepted in bad_rewrite.yaml")
+	}
+	if !strings.Contains(err.Error(), "invalid rewrite rule for site default") {
+		t.Errorf("Unexpected error. Expected an error about the rewrite rule, got %s", err.Error())
+	}
+}
+
+func TestBadGroups(t *testing.T) {
+	_, err := config.LoadConfig("bad_groups.yaml")
+	if err == nil {
+		t.Fatal("A site with both endpoints and groups was accepted in bad_groups.yaml")
+	}
+	if !strings.Contains(err.Error(), "site default cannot have both endpoints and groups") {
+		t.Errorf("Unexpected error. Expected an error about the endpoint groups, got %s", err.Error())
+	}
+}
+
+func TestBadMirror(t *testing.T) {
+	_, err := config.LoadConfig("bad_mirror.yaml")
+	if err == nil {
+		t.Fatal("A mirror to an unknown endpoint group was accepted in bad_mirror.yaml")
+	}
+	if !strings.Contains(err.Error(), "the site has no endpoint group \"shadow\"") {
+		t.Errorf("Unexpected error. Expected an error about the shadow group, got %s", err.Error())
+	}
+}
+
+func TestBadSiteType(t *testing.T) {
+	_, err := config.LoadConfig("bad_static.yaml")
+	if err == nil {
+		t.Fatal("A static site with endpoints was accepted in bad_static.yaml")
+	}
+	if !strings.Contains(err.Error(), "static site default cannot have endpoints") {
+		t.Errorf("Unexpected error. Expected an error about the endpoints, got %s", err.Error())
+	}
+}
+
+func TestBadTLS(t *testing.T) {
+	_, err := config.LoadConfig("bad_tls.yaml")
+	if err == nil {
+		t.Fatal("A site certificate on a plain HTTP port was accepted in bad_tls.yaml")
+	}
+	if !strings.Contains(err.Error(), "site shop has a certificate, but port 8080 has no TLS settings") {
+		t.Errorf("Unexpected error. Expected an error about the TLS port, got %s", err.Error())
+	}
+}
+
+func TestBadACME(t *testing.T) {
+	_, err := config.LoadConfig("bad_acme.yaml")
+	if err == nil {
+		t.Fatal("ACME settings without a cache directory were accepted in bad_acme.yaml")
+	}
+	if !strings.Contains(err.Error(), "invalid ACME settings: cache_dir is required") {
+		t.Errorf("Unexpected error. Expected an error about the cache directory, got %s", err.Error())
+	}
+}
+
+func TestBadAdmin(t *testing.T) {
+	_, err := config.LoadConfig("bad_admin.yaml")
+	if err == nil {
+		t.Fatal("An admin API on the port of a site was accepted in bad_admin.yaml")
+	}
+	if !strings.Contains(err.Error(), "admin port 8080 is already used by site default") {
+		t.Errorf("Unexpected error. Expected an error about the admin port, got %s", err.Error())
+	}
+}
+
 func TestInvalidYAML(t *testing.T) {
 	_, err := config.LoadConfig("/bin/false")
 	if err == nil {
@@ -86,6 +253,14 @@ func TestNoSuchFile(t *testing.T) {
 	}
 }
 
+// defaultHealthCheck is the health check of a site that doesn't configure one
+func defaultHealthCheck(period time.Duration) config.HealthCheckParsedConfig {
+	hc := config.DefaultHealthCheck()
+	hc.Jitter = period / 10
+	hc.MaxInterval = period * 8
+	return hc
+}
+
 func TestReadConfig(t *testing.T) {
 	c, err := config.LoadConfig("config_test.yaml")
 	if err != nil {
@@ -96,64 +271,156 @@ func TestReadConfig(t *testing.T) {
 	d2, _ := url.Parse("http://localhost:8082")
 	dDuration, _ := time.ParseDuration("10s")
 	defaultSite := config.SiteParsedConfig{
-		Endpoints:     []url.URL{*d1, *d2},
+		Endpoints:     []config.EndpointParsedConfig{{URL: *d1, Weight: 1}, {URL: *d2, Weight: 1}},
 		RefreshPeriod: dDuration,
 		Domain:        "",
 		Path:          "/*",
 		Port:          8080,
+		Algorithm:     "random",
+		Type:          "proxy",
+		HealthCheck:   defaultHealthCheck(dDuration),
 	}
 	s1u, _ := url.Parse("http://localhost:8083")
+	s1pu, _ := url.Parse("http://localhost:8084")
 	s1Duration, _ := time.ParseDuration("60s")
 	siteTest := config.SiteParsedConfig{
-		Endpoints:     []url.URL{*s1u},
+		Endpoints:     []config.EndpointParsedConfig{{URL: *s1u, Weight: 3}, {URL: *s1pu, Weight: 0}},
 		RefreshPeriod: s1Duration,
 		Domain:        "localhost",
 		Path:          "/folder/*",
 		Port:          5000,
+		Algorithm:     "round_robin",
+		Type:          "proxy",
+		HealthCheck:   defaultHealthCheck(s1Duration),
+		Match: &config.MatchParsedConfig{
+			Methods: []string{"GET"},
+			Headers: []config.ValueMatchParsedConfig{{Name: "X-Api-Version", Exact: "2"}},
+		},
 	}
 	du, _ := url.Parse("http://localhost:8280")
 	defaultTest := config.SiteParsedConfig{
-		Endpoints:     []url.URL{*du},
+		Endpoints:     []config.EndpointParsedConfig{{URL: *du, Weight: 1}},
 		RefreshPeriod: dDuration,
 		Domain:        "",
 		Path:          "/*",
 		Port:          c.ListeningPort,
+		Algorithm:     "random",
+		Type:          "proxy",
+		HealthCheck:   defaultHealthCheck(dDuration),
+		AgentCheck:    &config.AgentCheckParsedConfig{Port: 9999, Timeout: 2 * time.Second},
 	}
 	pu, _ := url.Parse("http://localhost:8380")
 	portTest := config.SiteParsedConfig{
-		Endpoints:     []url.URL{*pu},
-		RefreshPeriod: dDuration,
-		Domain:        "",
-		Path:          "/*",
-		Port:          6789,
+		Endpoints:       []config.EndpointParsedConfig{{URL: *pu, Weight: 1}},
+		RefreshPeriod:   dDuration,
+		Domain:          "",
+		Path:            "/*",
+		Port:            6789,
+		Algorithm:       "random",
+		Type:            "proxy",
+		HealthCheck:     defaultHealthCheck(dDuration),
+		ResponseTimeout: 45 * time.Second,
+		OutlierDetection: &config.OutlierDetectionParsedConfig{
+			ConsecutiveFailures: 10,
+			EjectionTime:        30 * time.Second,
+			MaxEjectionTime:     5 * time.Minute,
+			MaxEjectionPercent:  0,
+		},
 	}
 	pau, _ := url.Parse("http://localhost:5305")
 	pathTest := config.SiteParsedConfig{
-		Endpoints:     []url.URL{*pau},
+		Endpoints:     []config.EndpointParsedConfig{{URL: *pau, Weight: 1}},
 		RefreshPeriod: dDuration,
 		Domain:        "",
 		Path:          "/examplepath/*",
+		StripPrefix:   "/examplepath",
+		AddPrefix:     "/v1",
 		Port:          c.ListeningPort,
+		Algorithm:     "ring_hash",
+		Type:          "proxy",
+		HashKey:       config.HashKeyParsedConfig{Source: "cookie", Name: "session"},
+		HealthCheck:   defaultHealthCheck(dDuration),
 	}
 	domu, _ := url.Parse("http://localhost:8479")
+	domainHealthCheck := config.HealthCheckParsedConfig{
+		Type:               "http",
+		Path:               "/healthz",
+		Method:             "GET",
+		ExpectedStatuses:   []config.StatusRange{{Min: 200, Max: 200}, {Min: 300, Max: 399}},
+		Body:               "ok",
+		Headers:            map[string]string{"Host": "internal.example.com"},
+		Timeout:            2 * time.Second,
+		Port:               9000,
+		HealthyThreshold:   1,
+		UnhealthyThreshold: 5,
+		Concurrency:        2,
+		Jitter:             0,
+		MaxInterval:        time.Minute,
+	}
 	domainTest := config.SiteParsedConfig{
-		Endpoints:     []url.URL{*domu},
+		Endpoints:     []config.EndpointParsedConfig{{URL: *domu, Weight: 1}},
 		RefreshPeriod: dDuration,
 		Domain:        "example.com",
 		Path:          "/*",
 		Port:          c.ListeningPort,
+		Algorithm:     "random",
+		Type:          "proxy",
+		StickySession: &config.StickySessionParsedConfig{Cookie: "lbx_sticky_domain_test", Secret: "secret", MaxAge: time.Hour},
+		HealthCheck:   domainHealthCheck,
+	}
+	gsu, _ := url.Parse("http://localhost:8580")
+	gcu, _ := url.Parse("http://localhost:8581")
+	groupsTest := config.SiteParsedConfig{
+		RefreshPeriod: dDuration,
+		Domain:        "",
+		Path:          "/groups/*",
+		Port:          c.ListeningPort,
+		Algorithm:     "random",
+		Type:          "proxy",
+		HealthCheck:   defaultHealthCheck(dDuration),
+		Groups: []config.EndpointGroupParsedConfig{
+			{Name: "stable", Weight: 90, Endpoints: []config.EndpointParsedConfig{{URL: *gsu, Weight: 1}}},
+			{Name: "canary", Weight: 10, Endpoints: []config.EndpointParsedConfig{{URL: *gcu, Weight: 2}}},
+		},
+		GroupSticky: &config.GroupStickyParsedConfig{Cookie: "lbx_group", MaxAge: time.Hour},
+		Mirror: &config.MirrorParsedConfig{
+			Group:          "canary",
+			Percent:        5,
+			Compare:        true,
+			CompareHeaders: []string{"Content-Type"},
+			MaxBodySize:    1 << 20,
+			Timeout:        10 * time.Second,
+		},
+	}
+	redirectTest := config.SiteParsedConfig{
+		RefreshPeriod: dDuration,
+		Domain:        "old.example.com",
+		Path:          "/*",
+		Port:          c.ListeningPort,
+		Algorithm:     "random",
+		Type:          "redirect",
+		HealthCheck:   defaultHealthCheck(dDuration),
+		Redirect:      &config.RedirectParsedConfig{Status: 301, Target: "https://new.example.com{uri}"},
+		Maintenance:   &config.MaintenanceParsedConfig{Body: "back soon", ContentType: "text/html; charset=utf-8", RetryAfter: time.Hour},
 	}
 	expectedConfig := config.ParsedConfig{
 		ListeningPort: uint16(8080),
 		LogLevel:      1,
 		Sites: map[string]config.SiteParsedConfig{
-			"default":      defaultSite,
-			"site_test":    siteTest,
-			"default_test": defaultTest,
-			"domain_test":  domainTest,
-			"path_test":    pathTest,
-			"port_test":    portTest,
+			"default":       defaultSite,
+			"site_test":     siteTest,
+			"default_test":  defaultTest,
+			"domain_test":   domainTest,
+			"path_test":     pathTest,
+			"port_test":     portTest,
+			"groups_test":   groupsTest,
+			"redirect_test": redirectTest,
+		},
+		TLS: map[uint16]config.TLSListenerParsedConfig{
+			6789: {Cert: "default.crt", Key: "default.key", MinVersion: tls.VersionTLS13, CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}},
 		},
+		Admin:     &config.AdminParsedConfig{Listen: "127.0.0.1:9901", Port: 9901},
+		SiteOrder: []string{"default", "site_test", "default_test", "domain_test", "path_test", "port_test", "groups_test", "redirect_test"},
 	}
 	if !reflect.DeepEqual(expectedConfig, *c) {
 		fmt.Printf("Expected configuration: %v\n", expectedConfig)